@@ -49,9 +49,20 @@ func VerifyEventAuthChain(ctx context.Context, eventToVerify *HeaderedEvent, pro
 				return fmt.Errorf("gomatrixserverlib: VerifyEventAuthChain failed to obtain auth events: %w", err)
 			}
 			for i := range newEvents {
-				eventsByID[newEvents[i].EventID()] = newEvents[i] // add to lookup table
+				if newEvents[i] == nil {
+					continue // the provider may return partial results
+				}
+				if err := SameRoomAndVersion([]*Event{evv, newEvents[i]}); err != nil {
+					return fmt.Errorf("gomatrixserverlib: VerifyEventAuthChain: %w", err)
+				}
+				eventsByID[newEvents[i].EventID()] = newEvents[i]     // add to lookup table
+				eventsToVerify = append(eventsToVerify, newEvents[i]) // verify these events too
+			}
+			for _, needEventID := range need {
+				if eventsByID[needEventID] == nil {
+					return fmt.Errorf("gomatrixserverlib: VerifyEventAuthChain: auth event %s not found", needEventID)
+				}
 			}
-			eventsToVerify = append(eventsToVerify, newEvents...) // verify these events too
 		}
 		// verify the event
 		if err := checkAllowedByAuthEvents(curr, eventsByID, provideEvents); err != nil {
@@ -62,3 +73,17 @@ func VerifyEventAuthChain(ctx context.Context, eventToVerify *HeaderedEvent, pro
 	}
 	return nil
 }
+
+// MissingAuthEvents returns the IDs of the auth events of the given event that
+// the have function reports as not being present, in the order that they appear
+// in the event. These are the auth events that need to be fetched before the
+// event can be processed.
+func MissingAuthEvents(ev *Event, have func(id string) bool) []string {
+	var missing []string
+	for _, authEventID := range ev.AuthEventIDs() {
+		if !have(authEventID) {
+			missing = append(missing, authEventID)
+		}
+	}
+	return missing
+}
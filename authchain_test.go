@@ -2,6 +2,8 @@ package gomatrixserverlib_test
 
 import (
 	"context"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -70,6 +72,53 @@ func TestVerifyEventAuthChainCascadeFailure(t *testing.T) {
 	}
 }
 
+// A check that a provider which returns a partial result, omitting one of the requested auth events,
+// results in a clear error identifying the missing event rather than a panic.
+func TestVerifyEventAuthChainPartialProvider(t *testing.T) {
+	ctx := context.Background()
+	testEvents := [][]byte{
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":2,"event_id":"$xOJZshi3NeKKJiCf:baba.is.you","hashes":{"sha256":"lu5fF5HE090AXdu/+NpJ/RjRVRk/2tWCUozUc5t7Ru4"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"5KoVSLOBesqH9vciKXDExdu95lKFDtK1I72Hq1GG/UeEsH9jx7wL3V4jGYSKDnX2aLYp/VPiBQje7DFjde+hDQ"}},"type":"m.room.message"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":3,"event_id":"$4Kp0G1yWZ6tNpeI7:baba.is.you","hashes":{"sha256":"B+MjcGZRh72iaGOgyNbIxgFkHDJo6NO8NQDgiKDKDBA"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$xOJZshi3NeKKJiCf:baba.is.you",{"sha256":"5PGENImHC863Yz9sO6IJX+bIQthZFI2RMhFZyFy+bC0"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"rP+Ybp17GPCqQBrTQ3yz+q6PihdaMWvNY3SngV8aDLHv8wdDlH4ULGnjsB+Az7trqYdCE3rZVo9M7Hy5tOObDg"}},"type":"m.room.message"}`),
+	}
+	provider := provideEvents(t, testEvents)
+	partialProvider := func(roomVer gomatrixserverlib.RoomVersion, eventIDs []string) ([]*gomatrixserverlib.Event, error) {
+		events, err := provider(roomVer, eventIDs)
+		// also return a nil entry in place of the omitted event
+		return append(events, nil), err
+	}
+	testEvent, _ := gomatrixserverlib.NewEventFromTrustedJSON(testEvents[len(testEvents)-1], false, gomatrixserverlib.RoomVersionV1)
+	err := gomatrixserverlib.VerifyEventAuthChain(ctx, testEvent.Headered(gomatrixserverlib.RoomVersionV1), partialProvider)
+	if err == nil {
+		t.Fatalf("Expected event to fail auth chain checks, but passed")
+	}
+	if !strings.Contains(err.Error(), "auth event $fnwGrQEpiOIUoDU2:baba.is.you not found") {
+		t.Fatalf("Expected error to identify the missing auth event, got: %s", err)
+	}
+}
+
+// A check that MissingAuthEvents only returns the auth events that we don't already have, using the
+// auth events of a message event in room version 1 which are given as event reference tuples.
+func TestMissingAuthEvents(t *testing.T) {
+	testEvent, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":3,"event_id":"$4Kp0G1yWZ6tNpeI7:baba.is.you","hashes":{"sha256":"B+MjcGZRh72iaGOgyNbIxgFkHDJo6NO8NQDgiKDKDBA"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$xOJZshi3NeKKJiCf:baba.is.you",{"sha256":"5PGENImHC863Yz9sO6IJX+bIQthZFI2RMhFZyFy+bC0"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"rP+Ybp17GPCqQBrTQ3yz+q6PihdaMWvNY3SngV8aDLHv8wdDlH4ULGnjsB+Az7trqYdCE3rZVo9M7Hy5tOObDg"}},"type":"m.room.message"}`),
+		false, gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		t.Fatalf("Failed to load event: %s", err)
+	}
+	have := map[string]bool{
+		"$WCraVpPZe5TtHAqs:baba.is.you": true,
+	}
+	missing := gomatrixserverlib.MissingAuthEvents(testEvent, func(id string) bool {
+		return have[id]
+	})
+	want := []string{"$fnwGrQEpiOIUoDU2:baba.is.you"}
+	if !reflect.DeepEqual(missing, want) {
+		t.Fatalf("Expected missing auth events %v, got %v", want, missing)
+	}
+}
+
 func provideEvents(t *testing.T, events [][]byte) gomatrixserverlib.AuthChainProvider {
 	eventMap := make(map[string]*gomatrixserverlib.Event)
 	for _, eventBytes := range events {
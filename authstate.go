@@ -75,6 +75,50 @@ func (p *FederatedStateProvider) StateBeforeEvent(ctx context.Context, roomVer R
 	return result, nil
 }
 
+// StateFetchPlan returns the subset of stateIDs, as returned by /state_ids, that
+// are not present in knownEventIDs and therefore still need to be fetched. This
+// lets a server which already has most of the room state fetch just the missing
+// events instead of requesting the entire state with /state. The returned IDs are
+// in the same order as stateIDs, with duplicates removed.
+func StateFetchPlan(knownEventIDs map[string]bool, stateIDs []string) (needFetch []string) {
+	seen := make(map[string]struct{}, len(stateIDs))
+	for _, eventID := range stateIDs {
+		if knownEventIDs[eventID] {
+			continue
+		}
+		if _, ok := seen[eventID]; ok {
+			continue
+		}
+		seen[eventID] = struct{}{}
+		needFetch = append(needFetch, eventID)
+	}
+	return needFetch
+}
+
+// SenderServerInRoom returns true if the server that sent the given event has at
+// least one joined member in the supplied room state, false otherwise. This can be
+// used to detect events which have been injected by servers that are not otherwise
+// participating in the room.
+func SenderServerInRoom(ev *Event, stateAtEvent []*Event) bool {
+	_, senderDomain, err := SplitID('@', ev.Sender())
+	if err != nil {
+		return false
+	}
+	for _, stateEvent := range stateAtEvent {
+		if stateEvent.Type() != MRoomMember || stateEvent.StateKey() == nil {
+			continue
+		}
+		_, domain, err := SplitID('@', *stateEvent.StateKey())
+		if err != nil || domain != senderDomain {
+			continue
+		}
+		if membership, err := stateEvent.Membership(); err == nil && membership == Join {
+			return true
+		}
+	}
+	return false
+}
+
 // VerifyAuthRulesAtState will check that the auth_events in the given event are valid at the state of the room before that event.
 //
 // This implements Step 5 of https://matrix.org/docs/spec/server_server/latest#checks-performed-on-receipt-of-a-pdu
@@ -2,6 +2,7 @@ package gomatrixserverlib
 
 import (
 	"context"
+	"reflect"
 	"testing"
 )
 
@@ -150,3 +151,52 @@ func makeEvents(t *testing.T, in [][]byte) (out []*Event) {
 	}
 	return out
 }
+
+func TestStateFetchPlan(t *testing.T) {
+	stateIDs := []string{"$create", "$power_levels", "$join_rules", "$alice", "$bob", "$charlie"}
+	known := map[string]bool{
+		"$create":       true,
+		"$power_levels": true,
+		"$join_rules":   true,
+	}
+	want := []string{"$alice", "$bob", "$charlie"}
+	got := StateFetchPlan(known, stateIDs)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("StateFetchPlan: got %v want %v", got, want)
+	}
+	if got := StateFetchPlan(known, []string{"$create", "$join_rules"}); len(got) != 0 {
+		t.Fatalf("StateFetchPlan: got %v want nothing", got)
+	}
+}
+
+func TestSenderServerInRoom(t *testing.T) {
+	mustParse := func(eventJSON string) *Event {
+		t.Helper()
+		ev, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatalf("failed to parse event: %s", err)
+		}
+		return ev
+	}
+	state := []*Event{
+		mustParse(`{"type":"m.room.create","state_key":"","sender":"@alice:a","room_id":"!r:a","event_id":"$create:a","content":{"creator":"@alice:a"}}`),
+		mustParse(`{"type":"m.room.member","state_key":"@alice:a","sender":"@alice:a","room_id":"!r:a","event_id":"$alice:a","content":{"membership":"join"}}`),
+		mustParse(`{"type":"m.room.member","state_key":"@bob:b","sender":"@bob:b","room_id":"!r:a","event_id":"$bob:b","content":{"membership":"leave"}}`),
+		mustParse(`{"type":"m.room.member","state_key":"@charlie:c","sender":"@alice:a","room_id":"!r:a","event_id":"$charlie:a","content":{"membership":"invite"}}`),
+	}
+	for _, tc := range []struct {
+		sender string
+		want   bool
+	}{
+		{"@alice:a", true},
+		{"@mallory:a", true},
+		{"@bob:b", false},
+		{"@charlie:c", false},
+		{"@mallory:evil", false},
+	} {
+		ev := mustParse(`{"type":"m.room.message","sender":"` + tc.sender + `","room_id":"!r:a","event_id":"$msg:a","content":{"body":"hello"}}`)
+		if got := SenderServerInRoom(ev, state); got != tc.want {
+			t.Errorf("SenderServerInRoom for %s: got %v want %v", tc.sender, got, tc.want)
+		}
+	}
+}
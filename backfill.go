@@ -51,50 +51,128 @@ func RequestBackfill(ctx context.Context, b BackfillRequester, keyRing JSONVerif
 	if len(fromEventIDs) == 0 {
 		return nil, nil
 	}
-	haveEventIDs := make(map[string]bool)
-	var result []*HeaderedEvent
 	loader := NewEventsLoader(ver, keyRing, b, b.ProvideEvents, false)
 	// pick a server to backfill from
 	// TODO: use other event IDs and make a set out of all the returned servers?
 	servers := b.ServersAtEvent(ctx, roomID, fromEventIDs[0])
-	// loop each server asking it for `limit` events. Worst case, we ask every server for `limit`
-	// events before giving up. Best case, we just ask one.
+	loadResults, err := backfillAndVerify(ctx, b, servers, roomID, fromEventIDs, limit, loader)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, nil // none of the servers returned any events
+	}
+	var result []*HeaderedEvent
+	for _, res := range loadResults {
+		if backfillResultRank(res) > 0 {
+			result = append(result, res.Event)
+		}
+	}
+	return result, nil
+}
+
+// PerformBackfill asks each of the given servers in turn for events before the
+// given event IDs, until at least limit events have been verified or there are
+// no more servers to ask. The events are verified using the loader and only
+// events in the given room are kept. An event returned by more than one server
+// is only included once, preferring the copy which got furthest through
+// verification. Events whose only error is a SignatureErr count as verified,
+// as they do for RequestBackfill. Events which couldn't be parsed are not
+// included, since they can't be ordered.
+// The results are returned in reverse topological order of prev_events, with
+// the earliest events first, ready to be ingested. An error is returned if
+// none of the servers returned any events.
+func (ac *FederationClient) PerformBackfill(
+	ctx context.Context, servers []ServerName, roomID string, from []string, limit int, loader *EventsLoader,
+) ([]*EventLoadResult, error) {
+	if len(from) == 0 {
+		return nil, nil
+	}
+	return backfillAndVerify(ctx, ac, servers, roomID, from, limit, loader)
+}
+
+// backfillAndVerify is the fetch and verify loop shared by RequestBackfill and
+// PerformBackfill. It asks each server in turn for `limit` events, so in the
+// worst case every server is asked before giving up, and in the best case just
+// the first one. The results from all servers are returned in reverse
+// topological order of prev_events, so that implementations of 'get state at
+// event' can do optimisations.
+func backfillAndVerify(
+	ctx context.Context, client BackfillClient, servers []ServerName, roomID string, from []string, limit int, loader *EventsLoader,
+) ([]*EventLoadResult, error) {
+	results := make(map[string]*EventLoadResult)
+	verified := 0
+	var lastErr error
 	for _, s := range servers {
-		if len(result) >= limit {
+		if verified >= limit {
 			break
 		}
 		if ctx.Err() != nil {
-			return nil, fmt.Errorf("gomatrixserverlib: RequestBackfill context cancelled %w", ctx.Err())
+			return nil, fmt.Errorf("gomatrixserverlib: backfill context cancelled: %w", ctx.Err())
 		}
 		// fetch some events, and try a different server if it fails
-		txn, err := b.Backfill(ctx, s, roomID, limit, fromEventIDs)
+		txn, err := client.Backfill(ctx, s, roomID, limit, from)
 		if err != nil {
-			continue // try the next server
+			lastErr = fmt.Errorf("gomatrixserverlib: failed to backfill from %s: %w", s, err)
+			continue
 		}
-		// topologically sort the events so implementations of 'get state at event' can do optimisations
 		loadResults, err := loader.LoadAndVerify(ctx, txn.PDUs, TopologicalOrderByPrevEvents)
 		if err != nil {
-			continue // try the next server
+			lastErr = fmt.Errorf("gomatrixserverlib: failed to load backfilled events from %s: %w", s, err)
+			continue
 		}
-		for _, res := range loadResults {
-			switch res.Error.(type) {
-			case nil, SignatureErr:
-				// The signature of the event might not be valid anymore, for example if
-				// the key ID was reused with a different signature.
-			case AuthChainErr, AuthRulesErr:
-				continue
-			default:
+		for i := range loadResults {
+			result := loadResults[i]
+			if result.Event == nil || result.Event.RoomID() != roomID {
 				continue
 			}
-			if haveEventIDs[res.Event.EventID()] {
-				continue // we got this event from a different server
+			eventID := result.Event.EventID()
+			rank := backfillResultRank(&result)
+			if existing, ok := results[eventID]; ok {
+				if backfillResultRank(existing) >= rank {
+					continue // we already have an equally good copy of this event from a different server
+				}
+				if backfillResultRank(existing) > 0 {
+					verified--
+				}
 			}
-			haveEventIDs[res.Event.EventID()] = true
-			result = append(result, res.Event)
+			if rank > 0 {
+				verified++
+			}
+			results[eventID] = &result
+		}
+	}
+	if len(results) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("gomatrixserverlib: no servers returned any backfilled events")
 		}
+		return nil, lastErr
+	}
+	events := make([]*Event, 0, len(results))
+	for _, result := range results {
+		events = append(events, result.Event.Unwrap())
+	}
+	sorted := make([]*EventLoadResult, 0, len(results))
+	for _, event := range ReverseTopologicalOrdering(events, TopologicalOrderByPrevEvents) {
+		sorted = append(sorted, results[event.EventID()])
 	}
+	return sorted, nil
+}
 
-	return result, nil
+// backfillResultRank ranks how far a backfilled event got through
+// verification, so that the best copy of an event can be kept when more than
+// one server returns it. Events with a rank above zero are kept.
+func backfillResultRank(result *EventLoadResult) int {
+	switch result.Error.(type) {
+	case nil:
+		return 2
+	case SignatureErr:
+		// The signature of the event might not be valid anymore, for example if
+		// the key ID was reused with a different signature.
+		return 1
+	default:
+		return 0
+	}
 }
 
 /*
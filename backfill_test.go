@@ -5,9 +5,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"sort"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 type testBackfillRequester struct {
@@ -192,6 +197,107 @@ func TestRequestBackfillTopologicalSort(t *testing.T) {
 
 }
 
+type testBackfillTransport func(req *http.Request) (*http.Response, error)
+
+func (t testBackfillTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t(req)
+}
+
+// The purpose of this test is to make sure that PerformBackfill tries the next server when a
+// server fails or returns a partial response, and that overlapping events from different
+// servers are only returned once, in topological order.
+func TestPerformBackfill(t *testing.T) {
+	ctx := context.Background()
+	testRoomID := "!roomid:baba.is.you"
+	serverA := ServerName("wall.is.stop")
+	serverB := ServerName("baba.is.you")
+	serverC := ServerName("flag.is.win")
+	testFromEventIDs := []string{"foo"}
+	testLimit := 4
+	wantOrder := []string{
+		"$WCraVpPZe5TtHAqs:baba.is.you", "$fnwGrQEpiOIUoDU2:baba.is.you", "$xOJZshi3NeKKJiCf:baba.is.you", "$4Kp0G1yWZ6tNpeI7:baba.is.you",
+	}
+	testBackfillEvents := [][]byte{
+		[]byte(`{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"content":{"membership":"join"},"depth":1,"event_id":"$fnwGrQEpiOIUoDU2:baba.is.you","hashes":{"sha256":"DqOjdFgvFQ3V/jvQW2j3ygHL4D+t7/LaIPZ/tHTDZtI"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"qBWLb42zicQVsbh333YrcKpHfKokcUOM/ytldGlrgSdXqDEDDxvpcFlfadYnyvj3Z/GjA2XZkqKHanNEh575Bw"}},"state_key":"@userid:baba.is.you","type":"m.room.member"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":2,"event_id":"$xOJZshi3NeKKJiCf:baba.is.you","hashes":{"sha256":"lu5fF5HE090AXdu/+NpJ/RjRVRk/2tWCUozUc5t7Ru4"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"5KoVSLOBesqH9vciKXDExdu95lKFDtK1I72Hq1GG/UeEsH9jx7wL3V4jGYSKDnX2aLYp/VPiBQje7DFjde+hDQ"}},"type":"m.room.message"}`),
+		[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":3,"event_id":"$4Kp0G1yWZ6tNpeI7:baba.is.you","hashes":{"sha256":"B+MjcGZRh72iaGOgyNbIxgFkHDJo6NO8NQDgiKDKDBA"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$xOJZshi3NeKKJiCf:baba.is.you",{"sha256":"5PGENImHC863Yz9sO6IJX+bIQthZFI2RMhFZyFy+bC0"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"rP+Ybp17GPCqQBrTQ3yz+q6PihdaMWvNY3SngV8aDLHv8wdDlH4ULGnjsB+Az7trqYdCE3rZVo9M7Hy5tOObDg"}},"type":"m.room.message"}`),
+	}
+	tbr := &testBackfillRequester{
+		authEventsToProvide: testBackfillEvents,
+		stateIDsAtEvent: map[string][]string{
+			"$4Kp0G1yWZ6tNpeI7:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$xOJZshi3NeKKJiCf:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$fnwGrQEpiOIUoDU2:baba.is.you": {"$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$WCraVpPZe5TtHAqs:baba.is.you": nil,
+		},
+	}
+	var requested []ServerName
+	transport := testBackfillTransport(func(req *http.Request) (*http.Response, error) {
+		server := ServerName(req.URL.Host)
+		requested = append(requested, server)
+		var pdus []json.RawMessage
+		switch server {
+		case serverA:
+			// server A fails.
+			return &http.Response{
+				StatusCode: 500,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"errcode":"M_UNKNOWN"}`)),
+			}, nil
+		case serverB:
+			// server B only returns events 3 and 1.
+			pdus = []json.RawMessage{testBackfillEvents[3], testBackfillEvents[1]}
+		case serverC:
+			// server C returns events 2, 0 and 3.
+			pdus = []json.RawMessage{testBackfillEvents[2], testBackfillEvents[0], testBackfillEvents[3]}
+		default:
+			return nil, fmt.Errorf("bad server name: %s", server)
+		}
+		body, err := json.Marshal(Transaction{
+			Origin:         server,
+			OriginServerTS: AsTimestamp(time.Now()),
+			PDUs:           pdus,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := NewFederationClient("local.server.name", "ed25519:auto", privateKey, WithTransport(transport))
+	loader := NewEventsLoader(RoomVersionV1, &testNopJSONVerifier{}, tbr, tbr.ProvideEvents, false)
+
+	results, err := fc.PerformBackfill(ctx, []ServerName{serverA, serverB, serverC}, testRoomID, testFromEventIDs, testLimit, loader)
+	if err != nil {
+		t.Fatalf("PerformBackfill got error: %s", err)
+	}
+	if len(requested) != 3 {
+		t.Fatalf("expected all three servers to be asked, asked %v", requested)
+	}
+	if len(results) != len(wantOrder) {
+		t.Fatalf("PerformBackfill got %d results, want %d", len(results), len(wantOrder))
+	}
+	for i, result := range results {
+		if result.Error != nil {
+			t.Fatalf("result %d has error: %s", i, result.Error)
+		}
+		if result.Event.EventID() != wantOrder[i] {
+			t.Errorf("result %d has event ID %s, want %s", i, result.Event.EventID(), wantOrder[i])
+		}
+	}
+
+	// If every server fails then an error is returned.
+	if _, err = fc.PerformBackfill(ctx, []ServerName{serverA}, testRoomID, testFromEventIDs, testLimit, loader); err == nil {
+		t.Fatalf("expected PerformBackfill to fail when every server fails")
+	}
+}
+
 func assertUnsortedEqual(t *testing.T, result []*HeaderedEvent, want [][]byte) {
 	if len(result) != len(want) {
 		t.Fatalf("RequestBackfill got %d events, want %d", len(result), len(want))
@@ -224,3 +330,56 @@ func (b sortByteSlices) Less(i, j int) bool {
 func (b sortByteSlices) Swap(i, j int) {
 	b[j], b[i] = b[i], b[j]
 }
+
+// The purpose of this test is to make sure that events rejected by a strict loader for having
+// unexpected signers are dropped from backfill, rather than kept like events with SignatureErr.
+func TestBackfillDropsUnexpectedSigners(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+	_, unrelatedKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := room.events[1].Sign("c.com", "ed25519:unrelated", unrelatedKey)
+	room.events[1] = &signed
+
+	tbr := &testBackfillRequester{
+		backfillFn: func(server ServerName, roomID string, fromEventIDs []string, limit int) (*Transaction, error) {
+			return &Transaction{Origin: server, PDUs: room.rawEvents()}, nil
+		},
+	}
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithUnexpectedSignerCheck(true),
+	)
+	results, err := backfillAndVerify(context.Background(), tbr, []ServerName{"a.com"}, "!room:a.com", []string{"foo"}, 10, loader)
+	if err != nil {
+		t.Fatalf("backfillAndVerify got error: %s", err)
+	}
+	kept := 0
+	for _, result := range results {
+		if backfillResultRank(result) == 0 {
+			if _, ok := result.Error.(UnexpectedSignerErr); !ok {
+				t.Fatalf("event %s dropped with unexpected error %v", result.Event.EventID(), result.Error)
+			}
+			continue
+		}
+		if result.Event.EventID() == signed.EventID() {
+			t.Fatalf("expected the event with an unexpected signer to be dropped")
+		}
+		kept++
+	}
+	if kept != 1 {
+		t.Fatalf("expected only the create event to be kept, kept %d events", kept)
+	}
+}
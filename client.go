@@ -42,8 +42,11 @@ const requestTimeout time.Duration = time.Duration(30) * time.Second
 // centralise a number of configurable options, such as DNS caching,
 // timeouts etc.
 type Client struct {
-	client    http.Client
-	userAgent string
+	client http.Client
+	// plainClient is used for requests to URLs that aren't matrix servers,
+	// such as media redirects, so it doesn't do matrix server resolution.
+	plainClient http.Client
+	userAgent   string
 }
 
 // UserInfo represents information about a user.
@@ -73,6 +76,10 @@ func NewClient(options ...ClientOption) *Client {
 	for _, option := range options {
 		option(clientOpts)
 	}
+	plainTransport := clientOpts.transport
+	if plainTransport == nil {
+		plainTransport = newPlainTransport(clientOpts.skipVerify, clientOpts.dnsCache)
+	}
 	if clientOpts.transport == nil {
 		clientOpts.transport = newDestinationTripper(
 			clientOpts.skipVerify,
@@ -86,13 +93,18 @@ func NewClient(options ...ClientOption) *Client {
 			Transport: clientOpts.transport,
 			Timeout:   clientOpts.timeout,
 		},
+		plainClient: http.Client{
+			Transport: plainTransport,
+			Timeout:   clientOpts.timeout,
+		},
 	}
 	return client
 }
 
 // WithTransport is an option that can be supplied to either NewClient or
 // NewFederationClient. Supplying this option will render WithDNSCache and
-// WithSkipVerify ineffective.
+// WithSkipVerify ineffective. The transport is also used for requests to URLs
+// that aren't matrix servers, such as media redirects.
 func WithTransport(transport http.RoundTripper) ClientOption {
 	return func(options *clientOptions) {
 		options.transport = transport
@@ -191,6 +203,24 @@ var destinationTripperDialer = &net.Dialer{
 	Timeout: time.Second * 5,
 }
 
+// newPlainTransport returns a transport for requests to URLs that aren't
+// matrix servers, using the same dialer and TLS settings as the federation
+// transports.
+func newPlainTransport(skipVerify bool, dnsCache *DNSCache) *http.Transport {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: skipVerify,
+		},
+		DialContext:       destinationTripperDialer.DialContext,
+		Proxy:             http.ProxyFromEnvironment,
+		ForceAttemptHTTP2: true,
+	}
+	if dnsCache != nil {
+		tr.DialContext = dnsCache.DialContext
+	}
+	return tr
+}
+
 type destinationTripperTransport struct {
 	*http.Transport
 	lastUsed atomic.Value // time.Time
@@ -282,10 +312,15 @@ retryResolution:
 	var resp *http.Response
 	// TODO: respect the priority and weight fields from the SRV record
 	for _, result := range resolutionResults {
+		// Send a copy of the request to the delegated host, so that the
+		// caller's request still refers to the server name it was made for
+		// and the response is attributed to that server rather than to
+		// the host that it was delegated to.
 		u := makeHTTPSURL(r.URL, result.Destination)
-		r.URL = &u
-		r.Host = string(result.Host)
-		resp, err = f.getTransport(result.TLSServerName).RoundTrip(r)
+		delegated := r.Clone(r.Context())
+		delegated.URL = &u
+		delegated.Host = string(result.Host)
+		resp, err = f.getTransport(result.TLSServerName).RoundTrip(delegated)
 		if err == nil {
 			return resp, nil
 		}
@@ -380,6 +415,14 @@ func (fc *Client) GetServerKeys(
 	err = fc.DoRequestAndParseResponse(
 		ctx, req, &body,
 	)
+	if err == nil && body.ServerName != matrixServer {
+		// The request may have been delegated to another host, but the keys
+		// must still be the keys of the server that we asked for.
+		err = fmt.Errorf(
+			"gomatrixserverlib: server keys from %q are for server %q",
+			matrixServer, body.ServerName,
+		)
+	}
 	return body, err
 }
 
@@ -512,32 +555,7 @@ func (fc *Client) DoRequestAndParseResponse(
 	}
 
 	if response.StatusCode/100 != 2 { // not 2xx
-		// Adapted from https://github.com/matrix-org/gomatrix/blob/master/client.go
-		var contents []byte
-		contents, err = ioutil.ReadAll(response.Body)
-		if err != nil {
-			return err
-		}
-
-		var wrap error
-		var respErr gomatrix.RespError
-		if _ = json.Unmarshal(contents, &respErr); respErr.ErrCode != "" {
-			wrap = respErr
-		}
-
-		// If we failed to decode as RespError, don't just drop the HTTP body, include it in the
-		// HTTP error instead (e.g proxy errors which return HTML).
-		msg := fmt.Sprintf("Failed to %s JSON (hostname %q path %q)", req.Method, req.Host, req.URL.Path)
-		if wrap == nil {
-			msg += ": " + string(contents)
-		}
-
-		return gomatrix.HTTPError{
-			Code:         response.StatusCode,
-			Message:      msg,
-			WrappedError: wrap,
-			Contents:     contents,
-		}
+		return httpErrorFromResponse(req, response)
 	}
 
 	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
@@ -547,6 +565,36 @@ func (fc *Client) DoRequestAndParseResponse(
 	return nil
 }
 
+// httpErrorFromResponse reads the body of a non-2xx response and returns a
+// gomatrix.HTTPError, wrapping a gomatrix.RespError if the body contains one.
+func httpErrorFromResponse(req *http.Request, response *http.Response) error {
+	// Adapted from https://github.com/matrix-org/gomatrix/blob/master/client.go
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	var wrap error
+	var respErr gomatrix.RespError
+	if _ = json.Unmarshal(contents, &respErr); respErr.ErrCode != "" {
+		wrap = respErr
+	}
+
+	// If we failed to decode as RespError, don't just drop the HTTP body, include it in the
+	// HTTP error instead (e.g proxy errors which return HTML).
+	msg := fmt.Sprintf("Failed to %s JSON (hostname %q path %q)", req.Method, req.Host, req.URL.Path)
+	if wrap == nil {
+		msg += ": " + string(contents)
+	}
+
+	return gomatrix.HTTPError{
+		Code:         response.StatusCode,
+		Message:      msg,
+		WrappedError: wrap,
+		Contents:     contents,
+	}
+}
+
 // DoHTTPRequest creates an outgoing request ID and adds it to the context
 // before sending off the request and awaiting a response.
 //
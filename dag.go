@@ -0,0 +1,83 @@
+package gomatrixserverlib
+
+import "fmt"
+
+// A DepthViolation describes an event whose depth is not greater than the
+// depth of one of its prev_events.
+type DepthViolation struct {
+	// The event ID and depth of the event.
+	EventID string
+	Depth   int64
+	// The event ID and depth of the prev_event.
+	PrevEventID    string
+	PrevEventDepth int64
+}
+
+// ValidateDepthMonotonicity checks that the depth of every event in the set
+// is strictly greater than the depth of each of its prev_events which are
+// also in the set. Prev events which are not in the set are ignored, since
+// the set of events received from a remote server will often be incomplete.
+// The returned violations are in the order of the given events. This is a
+// diagnostic only: a violation doesn't make an event invalid, but it may
+// indicate that the DAG is malformed.
+func ValidateDepthMonotonicity(events []*Event) []DepthViolation {
+	eventsByID := make(map[string]*Event, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
+	var violations []DepthViolation
+	for _, event := range events {
+		for _, prevEventID := range event.PrevEventIDs() {
+			prevEvent, ok := eventsByID[prevEventID]
+			if !ok {
+				continue
+			}
+			if event.Depth() <= prevEvent.Depth() {
+				violations = append(violations, DepthViolation{
+					EventID:        event.EventID(),
+					Depth:          event.Depth(),
+					PrevEventID:    prevEvent.EventID(),
+					PrevEventDepth: prevEvent.Depth(),
+				})
+			}
+		}
+	}
+	return violations
+}
+
+// AssignStreamPositions returns a position for each event in the batch, keyed
+// by event ID, starting from zero. The positions are consistent with the DAG:
+// every event has a greater position than each of its prev_events that are
+// also in the batch. Events which are not ordered by the DAG are tie-broken
+// using the same deterministic ordering as ReverseTopologicalOrdering, so
+// servers that process the same batch will assign the same relative order
+// regardless of the order that the events were received in. Events which
+// appear more than once in the batch are only given one position. An error
+// is returned if the prev_events of the batch contain a cycle.
+func AssignStreamPositions(events []*Event) (map[string]int, error) {
+	unique := make([]*Event, 0, len(events))
+	seen := make(map[string]struct{}, len(events))
+	for _, event := range events {
+		if _, ok := seen[event.EventID()]; ok {
+			continue
+		}
+		seen[event.EventID()] = struct{}{}
+		unique = append(unique, event)
+	}
+	positions := make(map[string]int, len(unique))
+	for i, event := range ReverseTopologicalOrdering(unique, TopologicalOrderByPrevEvents) {
+		positions[event.EventID()] = i
+	}
+	for _, event := range unique {
+		for _, prevEventID := range event.PrevEventIDs() {
+			prevPosition, ok := positions[prevEventID]
+			if ok && prevPosition >= positions[event.EventID()] {
+				return nil, fmt.Errorf(
+					"gomatrixserverlib: event %s can't be ordered after its prev event %s, the batch contains a cycle",
+					event.EventID(), prevEventID,
+				)
+			}
+		}
+	}
+	return positions, nil
+}
@@ -0,0 +1,107 @@
+package gomatrixserverlib
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func makeDepthTestEvent(t *testing.T, eventID string, depth int64, prevEventIDs ...string) *Event {
+	t.Helper()
+	prevEvents := "["
+	for i, prevEventID := range prevEventIDs {
+		if i > 0 {
+			prevEvents += ","
+		}
+		prevEvents += fmt.Sprintf(`[%q,{"sha256":"abc"}]`, prevEventID)
+	}
+	prevEvents += "]"
+	eventJSON := fmt.Sprintf(
+		`{"type":"m.room.message","sender":"@u1:a","room_id":"!r1:a","event_id":%q,"depth":%d,"prev_events":%s,"content":{}}`,
+		eventID, depth, prevEvents,
+	)
+	event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestValidateDepthMonotonicity(t *testing.T) {
+	events := []*Event{
+		makeDepthTestEvent(t, "$e1:a", 1),
+		makeDepthTestEvent(t, "$e2:a", 2, "$e1:a"),
+		makeDepthTestEvent(t, "$e3:a", 3, "$e2:a", "$missing:a"),
+		makeDepthTestEvent(t, "$e4:a", 4, "$e2:a", "$e3:a"),
+	}
+	if violations := ValidateDepthMonotonicity(events); len(violations) != 0 {
+		t.Fatalf("expected no violations, got %+v", violations)
+	}
+}
+
+func TestValidateDepthMonotonicityInversion(t *testing.T) {
+	events := []*Event{
+		makeDepthTestEvent(t, "$e1:a", 1),
+		makeDepthTestEvent(t, "$e2:a", 5, "$e1:a"),
+		makeDepthTestEvent(t, "$e3:a", 3, "$e1:a", "$e2:a"),
+		makeDepthTestEvent(t, "$e4:a", 3, "$e3:a"),
+	}
+	want := []DepthViolation{
+		{EventID: "$e3:a", Depth: 3, PrevEventID: "$e2:a", PrevEventDepth: 5},
+		{EventID: "$e4:a", Depth: 3, PrevEventID: "$e3:a", PrevEventDepth: 3},
+	}
+	if got := ValidateDepthMonotonicity(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ValidateDepthMonotonicity: got %+v want %+v", got, want)
+	}
+}
+
+func TestAssignStreamPositions(t *testing.T) {
+	events := []*Event{
+		makeDepthTestEvent(t, "$e1:a", 1),
+		makeDepthTestEvent(t, "$e2:a", 2, "$e1:a"),
+		makeDepthTestEvent(t, "$e3:a", 2, "$e1:a"),
+		makeDepthTestEvent(t, "$e4:a", 3, "$e2:a", "$e3:a"),
+		makeDepthTestEvent(t, "$e5:a", 3, "$e3:a", "$missing:a"),
+		makeDepthTestEvent(t, "$e6:a", 4, "$e4:a", "$e5:a"),
+	}
+	want, err := AssignStreamPositions(events)
+	if err != nil {
+		t.Fatalf("AssignStreamPositions failed: %s", err)
+	}
+	if len(want) != len(events) {
+		t.Fatalf("got %d positions, want %d", len(want), len(events))
+	}
+	for _, event := range events {
+		for _, prevEventID := range event.PrevEventIDs() {
+			if prevPosition, ok := want[prevEventID]; ok && prevPosition >= want[event.EventID()] {
+				t.Fatalf("event %s at %d is not after prev event %s at %d", event.EventID(), want[event.EventID()], prevEventID, prevPosition)
+			}
+		}
+	}
+
+	// The same batch in a different order, with a duplicate, should be
+	// assigned exactly the same positions.
+	shuffled := append([]*Event{events[3]}, events...)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	got, err := AssignStreamPositions(shuffled)
+	if err != nil {
+		t.Fatalf("AssignStreamPositions failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("AssignStreamPositions: got %v want %v", got, want)
+	}
+}
+
+func TestAssignStreamPositionsCycle(t *testing.T) {
+	events := []*Event{
+		makeDepthTestEvent(t, "$e1:a", 1),
+		makeDepthTestEvent(t, "$e2:a", 2, "$e1:a", "$e3:a"),
+		makeDepthTestEvent(t, "$e3:a", 3, "$e2:a"),
+	}
+	if _, err := AssignStreamPositions(events); err == nil {
+		t.Fatalf("expected a batch containing a cycle to be rejected")
+	}
+}
@@ -27,3 +27,28 @@ func (e BadJSONError) Error() string {
 func (e BadJSONError) Unwrap() error {
 	return e.err
 }
+
+// MissingContentHashError is returned when an event does not contain a
+// content hash using the SHA-256 algorithm, which is currently the only
+// algorithm required by the spec.
+type MissingContentHashError struct{}
+
+func (e MissingContentHashError) Error() string {
+	return "gomatrixserverlib: event has no sha256 content hash"
+}
+
+// MalformedSignatureError is returned when a signature can't possibly be
+// valid, either because it isn't valid unpadded base64 or because it doesn't
+// decode to the size of an ed25519 signature.
+type MalformedSignatureError struct {
+	SigningName string
+	KeyID       KeyID
+	Reason      string
+}
+
+func (e MalformedSignatureError) Error() string {
+	return fmt.Sprintf(
+		"gomatrixserverlib: malformed signature from %q with ID %q: %s",
+		e.SigningName, e.KeyID, e.Reason,
+	)
+}
@@ -53,7 +53,18 @@ type EventReference struct {
 
 // Event validation errors
 const (
-	EventValidationTooLarge int = 1
+	EventValidationTooLarge          int = 1
+	EventValidationBadDepth          int = 2
+	EventValidationTooManyReferences int = 3
+)
+
+// MaxPrevEvents and MaxAuthEvents are the maximum number of prev_events and
+// auth_events that an event received over federation can refer to. Events
+// which refer to more than this are rejected by NewEventFromUntrustedJSON,
+// since they can only be intended to make processing the room DAG expensive.
+const (
+	MaxPrevEvents = 20
+	MaxAuthEvents = 10
 )
 
 // EventValidationError is returned if there is a problem validating an event
@@ -310,7 +321,7 @@ func (eb *EventBuilder) Build(
 		}
 	}
 
-	if eventJSON, err = addContentHashesToEvent(eventJSON); err != nil {
+	if eventJSON, err = addContentHashesToEvent(eventJSON, roomVersion); err != nil {
 		return
 	}
 
@@ -385,6 +396,14 @@ func NewEventFromUntrustedJSON(eventJSON []byte, roomVersion RoomVersion) (resul
 		return
 	}
 
+	if err = checkEventDepth(eventJSON, result.Depth()); err != nil {
+		return
+	}
+
+	if err = result.checkEventReferenceCounts(); err != nil {
+		return
+	}
+
 	// Synapse removes these keys from events in case a server accidentally added them.
 	// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/crypto/event_signing.py#L57-L62
 	for _, key := range []string{"outlier", "destinations", "age_ts"} {
@@ -397,6 +416,11 @@ func NewEventFromUntrustedJSON(eventJSON []byte, roomVersion RoomVersion) (resul
 	eventJSON = CanonicalJSONAssumeValid(eventJSON)
 
 	if err = checkEventContentHash(eventJSON); err != nil {
+		// An event without a SHA-256 hash can't be verified at all, so
+		// reject it outright rather than redacting it.
+		if errors.Is(err, MissingContentHashError{}) {
+			return nil, err
+		}
 		result.redacted = true
 
 		// If the content hash doesn't match then we have to discard all non-essential fields
@@ -782,6 +806,42 @@ func (e *Event) CheckFields() error { // nolint: gocyclo
 	return nil
 }
 
+// checkEventDepth checks that the event has a depth, which is a required
+// field of every PDU, and that the depth isn't negative.
+func checkEventDepth(eventJSON []byte, depth int64) error {
+	if !gjson.GetBytes(eventJSON, "depth").Exists() {
+		return EventValidationError{
+			Code:    EventValidationBadDepth,
+			Message: "gomatrixserverlib: event has no depth",
+		}
+	}
+	if depth < 0 {
+		return EventValidationError{
+			Code:    EventValidationBadDepth,
+			Message: fmt.Sprintf("gomatrixserverlib: event has negative depth %d", depth),
+		}
+	}
+	return nil
+}
+
+// checkEventReferenceCounts checks that the event doesn't refer to more than
+// MaxPrevEvents prev_events or MaxAuthEvents auth_events.
+func (e *Event) checkEventReferenceCounts() error {
+	if l := len(e.PrevEventIDs()); l > MaxPrevEvents {
+		return EventValidationError{
+			Code:    EventValidationTooManyReferences,
+			Message: fmt.Sprintf("gomatrixserverlib: event has too many prev_events, %d > maximum %d", l, MaxPrevEvents),
+		}
+	}
+	if l := len(e.AuthEventIDs()); l > MaxAuthEvents {
+		return EventValidationError{
+			Code:    EventValidationTooManyReferences,
+			Message: fmt.Sprintf("gomatrixserverlib: event has too many auth_events, %d > maximum %d", l, MaxAuthEvents),
+		}
+	}
+	return nil
+}
+
 func checkID(id, kind string, sigil byte) (domain string, err error) {
 	domain, err = domainFromID(id)
 	if err != nil {
@@ -898,6 +958,17 @@ func (e *Event) Unsigned() []byte {
 	}
 }
 
+// ContentHashes returns the content hashes of the event, keyed by the
+// hash algorithm, e.g. "sha256". The hashes are unpadded base64.
+func (e *Event) ContentHashes() map[string]string {
+	hashes := map[string]string{}
+	gjson.GetBytes(e.eventJSON, "hashes").ForEach(func(algorithm, hash gjson.Result) bool {
+		hashes[algorithm.String()] = hash.String()
+		return true
+	})
+	return hashes
+}
+
 // Content returns the content JSON of the event.
 func (e *Event) Content() []byte {
 	switch fields := e.fields.(type) {
@@ -1074,8 +1145,13 @@ func (e *Event) AuthEventIDs() []string {
 	}
 }
 
-// Redacts returns the event ID of the event this event redacts.
+// Redacts returns the event ID of the event this event redacts. In room
+// versions where the "redacts" key is in the event content, it is read from
+// there instead.
 func (e *Event) Redacts() string {
+	if inContent, err := e.roomVersion.RedactsInContent(); err == nil && inContent {
+		return gjson.GetBytes(e.Content(), "redacts").Str
+	}
 	switch fields := e.fields.(type) {
 	case eventFormatV1Fields:
 		return fields.Redacts
@@ -1086,6 +1162,16 @@ func (e *Event) Redacts() string {
 	}
 }
 
+// RedactionTarget returns whether the event is a m.room.redaction event and,
+// if it is, the event ID of the event that it redacts, taking into account
+// where the room version puts the "redacts" key.
+func (e *Event) RedactionTarget() (isRedaction bool, target string) {
+	if e.Type() != MRoomRedaction {
+		return false, ""
+	}
+	return true, e.Redacts()
+}
+
 // RoomID returns the room ID of the room the event is in.
 func (e *Event) RoomID() string {
 	switch fields := e.fields.(type) {
@@ -1118,6 +1204,33 @@ func (e Event) MarshalJSON() ([]byte, error) {
 	return e.eventJSON, nil
 }
 
+// ToCompact returns the event in a compact form suitable for storage, which
+// is the canonical JSON of the event along with its room version. The event
+// can be loaded again with FromCompact.
+func (e Event) ToCompact() ([]byte, RoomVersion) {
+	return e.eventJSON, e.roomVersion
+}
+
+// FromCompact loads an event from the compact form returned by ToCompact. The
+// event ID, signatures and redaction state of the event are preserved, and its
+// signatures are not verified again. Like NewEventFromTrustedJSON, this must
+// only be used for events that have already been verified, e.g. when loading
+// events from a local database.
+func FromCompact(data []byte, ver RoomVersion) (Event, error) {
+	// Events are only stored with a mismatched content hash if they were
+	// redacted, either because the hash didn't match when the event was
+	// received or because a redaction was applied to the event.
+	redacted := false
+	if err := checkEventContentHash(data); err != nil && !errors.Is(err, MissingContentHashError{}) {
+		redacted = true
+	}
+	event, err := NewEventFromTrustedJSON(data, redacted, ver)
+	if err != nil {
+		return Event{}, err
+	}
+	return *event, nil
+}
+
 // Headered returns a HeaderedEvent encapsulating the original event, with the
 // supplied headers.
 func (e *Event) Headered(roomVersion RoomVersion) *HeaderedEvent {
@@ -1176,6 +1289,33 @@ func SplitID(sigil byte, id string) (local string, domain ServerName, err error)
 	return parts[0][1:], ServerName(parts[1]), nil
 }
 
+// SameRoomAndVersion returns an error if the given events are not all in the
+// same room, or were not all loaded with the same room version. Events must
+// pass this check before they can be safely compared or resolved together,
+// since mixing room versions would mean using inconsistent auth and hashing
+// rules. A nil or empty slice passes the check.
+func SameRoomAndVersion(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	first := events[0]
+	for _, event := range events[1:] {
+		if event.RoomID() != first.RoomID() {
+			return fmt.Errorf(
+				"gomatrixserverlib: event %s is in room %q but event %s is in room %q",
+				event.EventID(), event.RoomID(), first.EventID(), first.RoomID(),
+			)
+		}
+		if event.roomVersion != first.roomVersion {
+			return fmt.Errorf(
+				"gomatrixserverlib: event %s has room version %q but event %s has room version %q",
+				event.EventID(), event.roomVersion, first.EventID(), first.roomVersion,
+			)
+		}
+	}
+	return nil
+}
+
 // fixNilSlices corrects cases where nil slices end up with "null" in the
 // marshalled JSON because Go stupidly doesn't care about the type in this
 // situation.
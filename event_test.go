@@ -16,10 +16,14 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func benchmarkParse(b *testing.B, eventJSON string) {
@@ -180,3 +184,220 @@ func TestHeaderedEventToNewEventFromUntrustedJSON(t *testing.T) {
 		t.Fatal("expected an UnexpectedHeaderedEvent error but got:", err)
 	}
 }
+
+func TestNewEventFromUntrustedJSONUnknownHashAlgorithm(t *testing.T) {
+	eventJSON := `{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha1024":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`
+	_, err := NewEventFromUntrustedJSON([]byte(eventJSON), RoomVersionV1)
+	if !errors.Is(err, MissingContentHashError{}) {
+		t.Fatal("expected a MissingContentHashError error but got:", err)
+	}
+}
+
+func TestContentHashes(t *testing.T) {
+	eventJSON := `{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`
+	event, err := NewEventFromUntrustedJSON([]byte(eventJSON), RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"sha256": "EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"}
+	if got := event.ContentHashes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("content hashes: got %+v want %+v", got, want)
+	}
+}
+
+func TestSameRoomAndVersion(t *testing.T) {
+	mustEvent := func(eventID, roomID string, roomVersion RoomVersion) *Event {
+		t.Helper()
+		event, err := NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.message",
+			"sender": "@u1:a",
+			"room_id": "`+roomID+`",
+			"event_id": "`+eventID+`",
+			"content": {"body": "hello"}
+		}`), false, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	first := mustEvent("$e1:a", "!r1:a", RoomVersionV1)
+	second := mustEvent("$e2:a", "!r1:a", RoomVersionV1)
+	otherRoom := mustEvent("$e3:a", "!r2:a", RoomVersionV1)
+	otherVersion := mustEvent("$e4:a", "!r1:a", RoomVersionV2)
+
+	if err := SameRoomAndVersion(nil); err != nil {
+		t.Errorf("expected no error for no events, got %s", err)
+	}
+	if err := SameRoomAndVersion([]*Event{first, second}); err != nil {
+		t.Errorf("expected no error for consistent events, got %s", err)
+	}
+	if err := SameRoomAndVersion([]*Event{first, second, otherRoom}); err == nil {
+		t.Errorf("expected an error for events in different rooms")
+	}
+	if err := SameRoomAndVersion([]*Event{first, otherVersion}); err == nil {
+		t.Errorf("expected an error for events with different room versions")
+	}
+}
+
+func TestNewEventFromUntrustedJSONDepth(t *testing.T) {
+	// Room version 1 uses the tuple-reference format for prev_events and
+	// auth_events, whereas room version 6 uses plain event IDs.
+	references := map[RoomVersion]string{
+		RoomVersionV1: `"event_id":"$e1:localhost","auth_events":[["$create:localhost",{"sha256":"abcd"}]],"prev_events":[["$create:localhost",{"sha256":"abcd"}]]`,
+		RoomVersionV6: `"auth_events":["$create"],"prev_events":["$create"]`,
+	}
+	tests := []struct {
+		name        string
+		roomVersion RoomVersion
+		depth       string
+		wantErr     bool
+	}{
+		{"v1 positive depth", RoomVersionV1, `"depth":5,`, false},
+		{"v1 negative depth", RoomVersionV1, `"depth":-1,`, true},
+		{"v1 missing depth", RoomVersionV1, ``, true},
+		{"v6 positive depth", RoomVersionV6, `"depth":5,`, false},
+		{"v6 zero depth", RoomVersionV6, `"depth":0,`, false},
+		{"v6 negative depth", RoomVersionV6, `"depth":-1,`, true},
+		{"v6 missing depth", RoomVersionV6, ``, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unhashed := []byte(`{` + references[tt.roomVersion] + `,` + tt.depth +
+				`"content":{"name":"test"},"origin":"localhost","origin_server_ts":0,` +
+				`"room_id":"!roomid:localhost","sender":"@userid:localhost","state_key":"","type":"m.room.name"}`)
+			eventJSON, err := addContentHashesToEvent(unhashed, tt.roomVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			event, err := NewEventFromUntrustedJSON(eventJSON, tt.roomVersion)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("expected event to be accepted, got %s", err)
+				}
+				if event.Redacted() {
+					t.Fatalf("expected event not to be redacted")
+				}
+				return
+			}
+			var validationErr EventValidationError
+			if !errors.As(err, &validationErr) || validationErr.Code != EventValidationBadDepth {
+				t.Fatalf("expected EventValidationBadDepth error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewEventFromUntrustedJSONReferenceCounts(t *testing.T) {
+	eventIDs := func(n int) string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf(`"$e%d"`, i)
+		}
+		return "[" + strings.Join(ids, ",") + "]"
+	}
+	tests := []struct {
+		name       string
+		authEvents int
+		prevEvents int
+		wantErr    bool
+	}{
+		{"within bounds", MaxAuthEvents, MaxPrevEvents, false},
+		{"too many prev_events", 1, 1000, true},
+		{"too many auth_events", MaxAuthEvents + 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unhashed := []byte(`{"auth_events":` + eventIDs(tt.authEvents) +
+				`,"prev_events":` + eventIDs(tt.prevEvents) + `,"depth":5,` +
+				`"content":{"body":"test"},"origin":"localhost","origin_server_ts":0,` +
+				`"room_id":"!roomid:localhost","sender":"@userid:localhost","type":"m.room.message"}`)
+			eventJSON, err := addContentHashesToEvent(unhashed, RoomVersionV6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewEventFromUntrustedJSON(eventJSON, RoomVersionV6)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("expected event to be accepted, got %s", err)
+				}
+				return
+			}
+			var validationErr EventValidationError
+			if !errors.As(err, &validationErr) || validationErr.Code != EventValidationTooManyReferences {
+				t.Fatalf("expected EventValidationTooManyReferences error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRedactionTarget(t *testing.T) {
+	redaction, err := NewEventFromTrustedJSON([]byte(
+		`{"type":"m.room.redaction","redacts":"$target:a","event_id":"$redaction:a","room_id":"!r:a","sender":"@u1:a","content":{}}`,
+	), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isRedaction, target := redaction.RedactionTarget(); !isRedaction || target != "$target:a" {
+		t.Fatalf("expected redaction of $target:a, got isRedaction=%v target=%q", isRedaction, target)
+	}
+
+	message, err := NewEventFromTrustedJSON([]byte(
+		`{"type":"m.room.message","redacts":"$target:a","event_id":"$message:a","room_id":"!r:a","sender":"@u1:a","content":{"body":"hello"}}`,
+	), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isRedaction, target := message.RedactionTarget(); isRedaction || target != "" {
+		t.Fatalf("expected no redaction, got isRedaction=%v target=%q", isRedaction, target)
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for roomVersion, desc := range SupportedRoomVersions() {
+		if !desc.Supported {
+			continue
+		}
+		eb := EventBuilder{
+			Sender: "@u1:a",
+			RoomID: "!r1:a",
+			Type:   "m.room.message",
+			Depth:  1,
+		}
+		if err := eb.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		event, err := eb.Build(time.Unix(1, 0), "a", "ed25519:a_Obwu", privateKey1, roomVersion)
+		if err != nil {
+			t.Fatalf("room version %s: failed to build event: %s", roomVersion, err)
+		}
+		redacted := *event
+		redacted.Redact()
+
+		for _, original := range []Event{*event, redacted} {
+			data, ver := original.ToCompact()
+			if ver != roomVersion {
+				t.Fatalf("room version %s: got room version %s from ToCompact", roomVersion, ver)
+			}
+			if !bytes.Equal(data, original.JSON()) {
+				t.Fatalf("room version %s: compact form %s doesn't match event JSON %s", roomVersion, data, original.JSON())
+			}
+			loaded, err := FromCompact(data, ver)
+			if err != nil {
+				t.Fatalf("room version %s: FromCompact failed: %s", roomVersion, err)
+			}
+			if loaded.EventID() != original.EventID() {
+				t.Fatalf("room version %s: got event ID %s, want %s", roomVersion, loaded.EventID(), original.EventID())
+			}
+			if loaded.Redacted() != original.Redacted() {
+				t.Fatalf("room version %s: got redacted %v, want %v", roomVersion, loaded.Redacted(), original.Redacted())
+			}
+			if loaded.Version() != roomVersion {
+				t.Fatalf("room version %s: got room version %s after FromCompact", roomVersion, loaded.Version())
+			}
+			reserialized, _ := loaded.ToCompact()
+			if !bytes.Equal(reserialized, data) {
+				t.Fatalf("room version %s: re-serialized event %s doesn't match %s", roomVersion, reserialized, data)
+			}
+		}
+	}
+}
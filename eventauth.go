@@ -23,6 +23,7 @@ import (
 	"golang.org/x/crypto/ed25519"
 
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 const (
@@ -87,6 +88,8 @@ const (
 	MPresence = "m.presence"
 	// MRoomMembership https://github.com/matrix-org/matrix-doc/blob/clokep/restricted-rooms/proposals/3083-restricted-rooms.md
 	MRoomMembership = "m.room_membership"
+	// MSpaceChild https://spec.matrix.org/v1.5/client-server-api/#mspacechild
+	MSpaceChild = "m.space.child"
 )
 
 // StateNeeded lists the event types and state_keys needed to authenticate an event.
@@ -216,6 +219,50 @@ func StateNeededForAuth(events []*Event) (result StateNeeded) {
 	return
 }
 
+// SelectAuthEvents returns the events from the current room state that should
+// be used as the auth_events of a new event with the given type, state key,
+// sender and content, in the order that they should appear in the event.
+// The state key is only used for m.room.member events, where it is the target
+// user. Events that are needed but aren't in the state are skipped, as with
+// AuthEventReferences.
+// The join_authorised_via_users_server key of a join is only taken into
+// account if the room version allows restricted joins.
+func SelectAuthEvents(
+	eventType, stateKey, sender string, content json.RawMessage,
+	state []*Event, roomVer RoomVersion,
+) ([]*Event, error) {
+	var memberContent *membershipContent
+	if eventType == MRoomMember {
+		if err := json.Unmarshal(content, &memberContent); err != nil {
+			return nil, errorf("unparsable member event content: %s", err.Error())
+		}
+		allowRestricted, err := roomVer.MayAllowRestrictedJoinsInEventAuth()
+		if err != nil {
+			return nil, err
+		}
+		if !allowRestricted {
+			memberContent.AuthorizedVia = ""
+		}
+	} else if _, ok := roomVersionMeta[roomVer]; !ok {
+		return nil, UnsupportedRoomVersionError{Version: roomVer}
+	}
+	var needed StateNeeded
+	if err := accumulateStateNeeded(&needed, eventType, sender, &stateKey, memberContent); err != nil {
+		return nil, err
+	}
+	needed.Member = util.UniqueStrings(needed.Member)
+	needed.ThirdPartyInvite = util.UniqueStrings(needed.ThirdPartyInvite)
+
+	stateMap := StateMap(state)
+	authEvents := []*Event{}
+	for _, tuple := range needed.Tuples() {
+		if event, ok := stateMap[tuple]; ok {
+			authEvents = append(authEvents, event)
+		}
+	}
+	return authEvents, nil
+}
+
 func accumulateStateNeeded(result *StateNeeded, eventType, sender string, stateKey *string, content *membershipContent) (err error) {
 	switch eventType {
 	case MRoomCreate:
@@ -287,6 +334,36 @@ func thirdPartyInviteToken(thirdPartyInvite *MemberThirdPartyInvite) (string, er
 	return thirdPartyInvite.Signed.Token, nil
 }
 
+// MatchThirdPartyInvite returns the m.room.third_party_invite event that the
+// third_party_invite in the content of the given m.room.member event refers
+// to. The "signed.token" of the third_party_invite must match the state key of
+// an m.room.third_party_invite event in the state, otherwise an error is
+// returned.
+func MatchThirdPartyInvite(member *Event, state AuthEventProvider) (*Event, error) {
+	if member.Type() != MRoomMember {
+		return nil, errorf("event %s is not a m.room.member event", member.EventID())
+	}
+	content, err := NewMemberContentFromEvent(member)
+	if err != nil {
+		return nil, err
+	}
+	if content.ThirdPartyInvite == nil {
+		return nil, errorf("member event %s does not have a third_party_invite", member.EventID())
+	}
+	token, err := thirdPartyInviteToken(content.ThirdPartyInvite)
+	if err != nil {
+		return nil, errorf("member event %s has an invalid third_party_invite: %s", member.EventID(), err.Error())
+	}
+	thirdPartyInviteEvent, err := state.ThirdPartyInvite(token)
+	if err != nil {
+		return nil, err
+	}
+	if thirdPartyInviteEvent == nil {
+		return nil, errorf("no m.room.third_party_invite event with token %q", token)
+	}
+	return thirdPartyInviteEvent, nil
+}
+
 // AuthEventProvider provides auth_events for the authentication checks.
 type AuthEventProvider interface {
 	// Create returns the m.room.create event for the room or nil if there isn't a m.room.create event.
@@ -396,23 +473,66 @@ func newAllowerContext(provider AuthEventProvider) *allowerContext {
 // quick path designed to speed up state resolution.
 // It returns a NotAllowed error if the event is not allowed.
 // If there was an error loading the auth events then it returns that error.
+//
+// The auth rules are applied in the order that they are listed in the spec
+// and the first rule to reject the event wins, so the order of the checks
+// matters. The rule numbers in the comments below refer to the rules in
+// https://spec.matrix.org/v1.5/rooms/v1/#authorization-rules. Later room
+// versions insert and renumber rules, e.g. for knocking and restricted joins,
+// without changing the order of the rules below. Rule 2, which checks the
+// auth_events for duplicates and rejected events, is left to the caller as it
+// needs more than just the auth events to be performed.
 func (a *allowerContext) allowed(event *Event) error {
 	switch event.Type() {
 	case MRoomCreate:
+		// Rule 1: m.room.create events.
 		return a.createEventAllowed(event)
 	case MRoomAliases:
+		// Rules 3 and 4: m.room.aliases events, in room versions 1 to 5.
 		return a.aliasEventAllowed(event)
 	case MRoomMember:
+		// Rules 3 and 5: m.room.member events.
 		return a.memberEventAllowed(event)
 	case MRoomPowerLevels:
+		// Rules 3, 6, 8 and 9, followed by rule 10: m.room.power_levels events.
 		return a.powerLevelsEventAllowed(event)
 	case MRoomRedaction:
+		// Rules 3, 6, 8 and 9, followed by rule 11: m.room.redaction events.
 		return a.redactEventAllowed(event)
 	default:
+		// Rules 3, 6, 8 and 9, followed by rule 12: otherwise, allow.
 		return a.defaultEventAllowed(event)
 	}
 }
 
+// ValidateStateKey checks that the state key is of the right form for the
+// event type. The state key of m.room.create, m.room.power_levels and
+// m.room.join_rules events must be empty, the state key of m.room.member
+// events must be a user ID, and the state key of m.room.third_party_invite
+// events must be a non-empty token. Other event types can have any state key.
+// It returns a NotAllowed error if the state key is not valid.
+//
+// This is not one of the auth rules, so Allowed doesn't call it and events
+// from other servers must not be rejected because of it. It is meant for
+// checking events that are built locally.
+func ValidateStateKey(eventType, stateKey string) error {
+	switch eventType {
+	case MRoomCreate, MRoomPowerLevels, MRoomJoinRules:
+		if stateKey != "" {
+			return errorf("%s event state key is not empty: %q", eventType, stateKey)
+		}
+	case MRoomMember:
+		if _, _, err := SplitID('@', stateKey); err != nil {
+			return errorf("%s event state key is not a valid user ID: %q", eventType, stateKey)
+		}
+	case MRoomThirdPartyInvite:
+		if stateKey == "" {
+			return errorf("%s event state key is not a valid token: %q", eventType, stateKey)
+		}
+	}
+	return nil
+}
+
 // Allowed checks whether an event is allowed by the auth events.
 // It returns a NotAllowed error if the event is not allowed.
 // If there was an error loading the auth events then it returns that error.
@@ -426,6 +546,11 @@ func (a *allowerContext) createEventAllowed(event *Event) error {
 	if !event.StateKeyEquals("") {
 		return errorf("create event state key is not empty: %v", event.StateKey())
 	}
+	// Rule 1.1: If it has any previous events, reject.
+	if len(event.PrevEvents()) > 0 {
+		return errorf("create event must be the first event in the room: found %d prev_events", len(event.PrevEvents()))
+	}
+	// Rule 1.2: If the domain of the room_id does not match the domain of the sender, reject.
 	roomIDDomain, err := domainFromID(event.RoomID())
 	if err != nil {
 		return err
@@ -437,16 +562,60 @@ func (a *allowerContext) createEventAllowed(event *Event) error {
 	if senderDomain != roomIDDomain {
 		return errorf("create event room ID domain does not match sender: %q != %q", roomIDDomain, senderDomain)
 	}
-	if len(event.PrevEvents()) > 0 {
-		return errorf("create event must be the first event in the room: found %d prev_events", len(event.PrevEvents()))
-	}
 	c := map[string]json.RawMessage{}
 	if err := json.Unmarshal(event.Content(), &c); err != nil {
 		return errorf("create event has invalid content: %s", err.Error())
 	}
+	// Rule 1.3: If content.room_version is present and is not a recognised version, reject.
+	if rawVersion, ok := c["room_version"]; ok {
+		var roomVersion RoomVersion
+		if err := json.Unmarshal(rawVersion, &roomVersion); err != nil {
+			return errorf("create event has invalid room version: %s", err.Error())
+		}
+		if _, ok := roomVersionMeta[roomVersion]; !ok {
+			return errorf("create event has unrecognised room version %q", roomVersion)
+		}
+	}
+	// Rule 1.4: If content has no creator field, reject.
 	if _, ok := c["creator"]; !ok {
 		return errorf("create event has no creator field")
 	}
+	// Rule 1.5: Otherwise, allow.
+	return nil
+}
+
+// checkRedactsInContent checks that the m.room.redaction event has a plausible
+// event ID in the "redacts" key of its content, as required by the room
+// versions from room version 11.
+func checkRedactsInContent(event *Event) error {
+	redacts := gjson.GetBytes(event.Content(), "redacts")
+	if redacts.Type != gjson.String {
+		return errorf("redaction event has no 'redacts' string in content")
+	}
+	if redacts.Str == "" || redacts.Str[0] != '$' {
+		return errorf("redaction event has an invalid 'redacts' event ID: %q", redacts.Str)
+	}
+	return nil
+}
+
+// CheckRedactionTarget checks that the redaction event redacts the given target
+// event, and that the target event is in the same room as the redaction. This
+// can only be checked once the target event is known, which may be after the
+// redaction has been accepted into the room DAG. The EventsLoader checks this
+// for redactions whose target is loaded in the same batch.
+func CheckRedactionTarget(redaction, target *Event) error {
+	if redaction.Type() != MRoomRedaction {
+		return fmt.Errorf("gomatrixserverlib: event %s is not a redaction", redaction.EventID())
+	}
+	if redaction.Redacts() != target.EventID() {
+		return fmt.Errorf("gomatrixserverlib: redaction %s redacts %s, not %s", redaction.EventID(), redaction.Redacts(), target.EventID())
+	}
+	if redaction.RoomID() != target.RoomID() {
+		return fmt.Errorf(
+			"gomatrixserverlib: redaction %s is in room %q but redacted event %s is in room %q",
+			redaction.EventID(), redaction.RoomID(), target.EventID(), target.RoomID(),
+		)
+	}
 	return nil
 }
 
@@ -524,6 +693,19 @@ func (a *allowerContext) powerLevelsEventAllowed(event *Event) error {
 		}
 	}
 
+	// If there is no previous m.room.power_levels event in the room, allow.
+	// The sender has already been checked against the default levels, where
+	// the room creator has the highest level and everyone else has 0, so
+	// this is the initial power levels event being sent by the creator.
+	// https://spec.matrix.org/v1.5/rooms/v10/#authorization-rules
+	previous, err := a.provider.PowerLevels()
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		return nil
+	}
+
 	// Grab the old levels so that we can compare new the levels against them.
 	oldPowerLevels := a.powerLevels
 	senderLevel := oldPowerLevels.UserLevel(event.Sender())
@@ -562,6 +744,7 @@ func checkEventLevels(senderLevel int64, oldPowerLevels, newPowerLevels PowerLev
 		{oldPowerLevels.Redact, newPowerLevels.Redact},
 		{oldPowerLevels.StateDefault, newPowerLevels.StateDefault},
 		{oldPowerLevels.EventsDefault, newPowerLevels.EventsDefault},
+		{oldPowerLevels.UsersDefault, newPowerLevels.UsersDefault},
 	}
 
 	// Then add checks for each event key in the new levels.
@@ -630,37 +813,43 @@ func checkEventLevels(senderLevel int64, oldPowerLevels, newPowerLevels PowerLev
 // checkUserLevels checks that the changes in user levels are allowed.
 func checkUserLevels(senderLevel int64, senderID string, oldPowerLevels, newPowerLevels PowerLevelContent) error {
 	type levelPair struct {
-		old int64
-		new int64
+		old, new     int64
+		inOld, inNew bool
 	}
 
-	// Build a list of user levels to check.
+	// Build a list of user levels to check. This includes the users that
+	// are being removed from the users map as well as those that are being
+	// added or changed, and unlike the event levels the default level is
+	// not used for users that are missing from one of the old or new maps.
 	userLevelChecks := map[string]levelPair{}
-	for userID := range newPowerLevels.Users {
-		userLevelChecks[userID] = levelPair{
-			old: oldPowerLevels.Users[userID],
-			new: newPowerLevels.Users[userID],
-		}
+	for userID, level := range oldPowerLevels.Users {
+		userLevelChecks[userID] = levelPair{old: level, inOld: true}
+	}
+	for userID, level := range newPowerLevels.Users {
+		check := userLevelChecks[userID]
+		check.new, check.inNew = level, true
+		userLevelChecks[userID] = check
 	}
 
 	// Check each of the levels in the list.
 	for userID, level := range userLevelChecks {
 		// Check if the level is being changed.
-		if level.old == level.new {
+		if level.inOld && level.inNew && level.old == level.new {
 			// Levels are always allowed to stay the same.
 			continue
 		}
 
-		// Users are allowed to change the level of other users if:
+		// Users are allowed to add or change the level of other users if:
 		//   * the old level was less than their own
 		//   * the new level was less than or equal to their own
+		// They are allowed to remove the level of other users if:
+		//   * the old level was less than their own
 		// They are allowed to change their own level if:
 		//   * the new level was less than or equal to their own
-		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L1126-L1127
-		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L1134
+		// https://spec.matrix.org/v1.5/rooms/v1/#authorization-rules (rule 10.5)
 
 		// Check if the user is trying to set any of the levels to above their own.
-		if senderLevel < level.new {
+		if level.inNew && senderLevel < level.new {
 			return errorf(
 				"sender %q with level %d is not allowed change user %q level from %d to %d"+
 					" because the new level is above the level of the sender",
@@ -676,7 +865,7 @@ func checkUserLevels(senderLevel int64, senderID string, oldPowerLevels, newPowe
 		}
 
 		// Check if the user is changing the level that was above or the same as their own.
-		if senderLevel <= level.old {
+		if level.inOld && senderLevel <= level.old {
 			return errorf(
 				"sender %q with level %d is not allowed to change user %q level from %d to %d"+
 					" because the old level is equal to or above the level of the sender",
@@ -770,6 +959,18 @@ func (a *allowerContext) redactEventAllowed(event *Event) error {
 		return err
 	}
 
+	// and, in room versions that require the "redacts" key to be in the
+	// content, must have it there.
+	redactsInContent, err := event.roomVersion.RedactsInContent()
+	if err != nil {
+		return err
+	}
+	if redactsInContent {
+		if err = checkRedactsInContent(event); err != nil {
+			return err
+		}
+	}
+
 	roomVersion := allower.create.RoomVersion
 	if roomVersion != nil && *roomVersion != "1" && *roomVersion != "2" {
 		// We always accept redaction events into the DAG for rooms >= v3 after the
@@ -846,6 +1047,8 @@ func (a *allowerContext) newEventAllower(senderID string) (e eventAllower, err e
 // commonChecks does the checks that are applied to all events types other than
 // m.room.create, m.room.member, or m.room.alias.
 func (e *eventAllower) commonChecks(event *Event) error {
+	// Rule 3: If the event does not have a m.room.create event in its auth_events, reject.
+	// The create event will have an empty room ID if it was missing.
 	if event.RoomID() != e.create.roomID {
 		return errorf(
 			"create event has different roomID: %q (%s) != %q (%s)",
@@ -856,16 +1059,19 @@ func (e *eventAllower) commonChecks(event *Event) error {
 	sender := event.Sender()
 	stateKey := event.StateKey()
 
+	// Check that the sender is allowed in the room by the m.federate flag.
 	if err := e.create.UserIDAllowed(sender); err != nil {
 		return err
 	}
 
-	// Check that the sender is in the room.
+	// Rule 6: If the sender's current membership state is not join, reject.
 	// Every event other than m.room.create, m.room.member and m.room.aliases require this.
 	if e.member.Membership != Join {
 		return errorf("sender %q not in room", sender)
 	}
 
+	// Rule 8: If the event type's required power level is greater than the
+	// sender's power level, reject.
 	senderLevel := e.powerLevels.UserLevel(sender)
 	eventLevel := e.powerLevels.EventLevel(event.Type(), stateKey != nil)
 	if senderLevel < eventLevel {
@@ -875,8 +1081,8 @@ func (e *eventAllower) commonChecks(event *Event) error {
 		)
 	}
 
-	// Check that all state_keys that begin with '@' are only updated by users
-	// with that ID.
+	// Rule 9: If the event has a state_key that starts with an @ and does not
+	// match the sender, reject.
 	if stateKey != nil && len(*stateKey) > 0 && (*stateKey)[0] == '@' {
 		if *stateKey != sender {
 			return errorf(
@@ -899,6 +1105,8 @@ type membershipAllower struct {
 	roomVersion RoomVersion
 	// The m.room.third_party_invite content referenced by this event.
 	thirdPartyInvite ThirdPartyInviteContent
+	// The user ID of the user who sent the m.room.third_party_invite event.
+	thirdPartyInviteSender string
 	// The user ID of the user whose membership is changing.
 	targetID string
 	// The user ID of the user who sent the membership event.
@@ -935,8 +1143,13 @@ func (a *allowerContext) newMembershipAllower(authEvents AuthEventProvider, even
 	}
 	// If this event comes from a third_party_invite, we need to check it against the original event.
 	if m.newMember.ThirdPartyInvite != nil {
-		token := m.newMember.ThirdPartyInvite.Signed.Token
-		if m.thirdPartyInvite, err = NewThirdPartyInviteContentFromAuthEvents(authEvents, token); err != nil {
+		var thirdPartyInviteEvent *Event
+		if thirdPartyInviteEvent, err = MatchThirdPartyInvite(event, authEvents); err != nil {
+			return
+		}
+		m.thirdPartyInviteSender = thirdPartyInviteEvent.Sender()
+		if err = json.Unmarshal(thirdPartyInviteEvent.Content(), &m.thirdPartyInvite); err != nil {
+			err = errorf("unparsable third party invite event content: %s", err.Error())
 			return
 		}
 	}
@@ -945,6 +1158,7 @@ func (a *allowerContext) newMembershipAllower(authEvents AuthEventProvider, even
 
 // membershipAllowed checks whether the membership event is allowed
 func (m *membershipAllower) membershipAllowed(event *Event) error { // nolint: gocyclo
+	// Rule 3: If the event does not have a m.room.create event in its auth_events, reject.
 	if m.create.roomID != event.RoomID() {
 		return errorf(
 			"create event has different roomID: %q (%s) != %q (%s)",
@@ -1056,6 +1270,14 @@ func (m *membershipAllower) membershipAllowedFromThirdPartyInvite() error {
 			m.targetID, m.newMember.ThirdPartyInvite.Signed.MXID,
 		)
 	}
+	// Check that the invite is sent by the same user who sent the
+	// m.room.third_party_invite event.
+	if m.senderID != m.thirdPartyInviteSender {
+		return errorf(
+			"The invite sender %s doesn't match the sender of the third party invite %s",
+			m.senderID, m.thirdPartyInviteSender,
+		)
+	}
 	// Marshal the "signed" so it can be verified by VerifyJSON.
 	marshalledSigned, err := json.Marshal(m.newMember.ThirdPartyInvite.Signed)
 	if err != nil {
@@ -1156,6 +1378,10 @@ func (m *membershipAllower) membershipAllowedSelf() error { // nolint: gocyclo
 		if m.oldMember.Membership == Invite {
 			return nil
 		}
+		// A knocking user is allowed to retract their knock.
+		if m.oldMember.Membership == Knock {
+			return nil
+		}
 		return m.membershipFailed(
 			"sender cannot leave from this state",
 		)
@@ -1209,6 +1435,7 @@ func (m *membershipAllower) membershipAllowedOther() error { // nolint: gocyclo
 			)
 		}
 		// A user may kick another user if their level is high enough.
+		// This also covers rejecting a knock, which requires the kick level.
 		// TODO: You can kick a user that was already kicked, or has left the room, or was
 		// never in the room in the first place. Do we want to allow these redundant kicks?
 		if senderLevel >= m.powerLevels.Kick && senderLevel > targetLevel {
@@ -1279,3 +1506,104 @@ func (m *membershipAllower) membershipFailed(format string, args ...interface{})
 		append([]interface{}{m.senderID, m.targetID, m.oldMember.Membership, m.newMember.Membership}, args...)...,
 	)
 }
+
+// RestrictedJoinMembershipProvider returns true if the given user is joined
+// to the given room. It is used by CanJoinRestricted to check whether the
+// user satisfies the allow rules of a restricted room.
+type RestrictedJoinMembershipProvider func(roomID, userID string) (bool, error)
+
+// CanJoinRestricted works out whether the given user is allowed to join a room
+// with a "restricted" or "knock_restricted" join rule, using the current state
+// of the room. Banned users are never allowed to join. Users who are already
+// joined or invited are allowed to join without an authorising user, since the
+// join rule is then treated as if it were "invite". Otherwise the user is
+// allowed to join if the provider reports that they are joined to any of the
+// rooms in the allow rules of the join rules. If they are, then a joined user
+// from authorisingServer with the power to invite is returned, who can be used
+// as the "join_authorised_via_users_server" of the join event, since the join
+// event must then be signed by authorisingServer. The user with the highest
+// power level is preferred.
+func CanJoinRestricted(userID string, state []*Event, isJoined RestrictedJoinMembershipProvider, authorisingServer ServerName) (allowed bool, authorisingUser string, err error) {
+	authEvents := NewAuthEvents(state)
+	create, err := NewCreateContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return false, "", err
+	}
+	roomVersion := RoomVersionV1
+	if create.RoomVersion != nil {
+		roomVersion = *create.RoomVersion
+	}
+	joinRule, err := NewJoinRuleContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return false, "", err
+	}
+	if joinRule.JoinRule != Restricted && joinRule.JoinRule != KnockRestricted {
+		return false, "", nil
+	}
+	allowsRestricted, err := roomVersion.AllowRestrictedJoinsInEventAuth(joinRule.JoinRule)
+	if err != nil {
+		return false, "", err
+	}
+	if !allowsRestricted {
+		return false, "", nil
+	}
+
+	// Check the current membership of the user in the room.
+	member, err := NewMemberContentFromAuthEvents(&authEvents, userID)
+	if err != nil {
+		return false, "", err
+	}
+	switch member.Membership {
+	case Ban:
+		return false, "", nil
+	case Join, Invite:
+		return true, "", nil
+	}
+
+	// Check if the user is joined to any of the allowed rooms.
+	for _, rule := range joinRule.Allow {
+		if rule.Type != MRoomMembership {
+			continue
+		}
+		if allowed, err = isJoined(rule.RoomID, userID); err != nil {
+			return false, "", fmt.Errorf("gomatrixserverlib: failed to check membership of %q in %q: %w", userID, rule.RoomID, err)
+		}
+		if allowed {
+			break
+		}
+	}
+	if !allowed {
+		return false, "", nil
+	}
+
+	// Find a joined user from the authorising server who has the power to
+	// invite the user.
+	powerLevels, err := NewPowerLevelContentFromAuthEvents(&authEvents, create.Creator)
+	if err != nil {
+		return false, "", err
+	}
+	authorisingLevel := int64(0)
+	for _, event := range state {
+		if event.Type() != MRoomMember || event.StateKey() == nil {
+			continue
+		}
+		if membership, merr := event.Membership(); merr != nil || membership != Join {
+			continue
+		}
+		memberID := *event.StateKey()
+		if _, domain, derr := SplitID('@', memberID); derr != nil || domain != authorisingServer {
+			continue
+		}
+		level := powerLevels.UserLevel(memberID)
+		if level < powerLevels.Invite {
+			continue
+		}
+		if authorisingUser == "" || level > authorisingLevel {
+			authorisingUser, authorisingLevel = memberID, level
+		}
+	}
+	if authorisingUser == "" {
+		return false, "", fmt.Errorf("gomatrixserverlib: no joined user from %q with the power to invite can authorise the join", authorisingServer)
+	}
+	return true, authorisingUser, nil
+}
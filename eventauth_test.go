@@ -17,6 +17,8 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -680,10 +682,85 @@ func TestAllowedInviteFrom3PID(t *testing.T) {
 			"unsigned": {
 				"not_allowed": "Token doesn't refer to a known third-party invite"
 			}
+		}, {
+			"type": "m.room.member",
+			"sender": "@u3:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:a",
+			"event_id": "$e7:a",
+			"content": {
+				"membership": "invite",
+				"third_party_invite": {
+					"display_name": "foo...@bar...",
+					"signed": {
+						"token": "my_token",
+						"mxid": "@u2:a",
+						"signatures": {
+							"example.tld": {
+								"ed25519:0": "CibGFS0vX93quJFppsQbYQKJFIwxiYEK87lNmekS/fdetUMXPdR2wwNDd09J1jJ28GCH3GogUTuFDB1ScPFxBg"
+							}
+						}
+					}
+				}
+			},
+			"unsigned": {
+				"not_allowed": "Sender doesn't match the sender of the third-party invite"
+			}
 		}]
 	}`)
 }
 
+func TestMatchThirdPartyInvite(t *testing.T) {
+	thirdPartyInvite, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.third_party_invite",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"state_key": "my_token",
+		"event_id": "$e1:a",
+		"content": {"display_name": "foo...@bar..."}
+	}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authEvents := NewAuthEvents([]*Event{thirdPartyInvite})
+
+	memberWithToken := func(token string) *Event {
+		member, err := NewEventFromTrustedJSON(RawJSON(`{
+			"type": "m.room.member",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:a",
+			"event_id": "$e2:a",
+			"content": {
+				"membership": "invite",
+				"third_party_invite": {
+					"display_name": "foo...@bar...",
+					"signed": {"token": "`+token+`", "mxid": "@u2:a", "signatures": {}}
+				}
+			}
+		}`), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return member
+	}
+
+	matched, err := MatchThirdPartyInvite(memberWithToken("my_token"), &authEvents)
+	if err != nil {
+		t.Fatalf("Expected the token to match a third party invite: %s", err)
+	}
+	if matched.EventID() != thirdPartyInvite.EventID() {
+		t.Fatalf("Expected to match %s, got %s", thirdPartyInvite.EventID(), matched.EventID())
+	}
+
+	if _, err = MatchThirdPartyInvite(memberWithToken("my_other_token"), &authEvents); err == nil {
+		t.Fatalf("Expected a token with no third party invite to be rejected")
+	}
+	if _, err = MatchThirdPartyInvite(memberWithToken(""), &authEvents); err == nil {
+		t.Fatalf("Expected an empty token to be rejected")
+	}
+}
+
 func TestAllowedNoFederation(t *testing.T) {
 	testEventAllowed(t, `{
 		"auth_events": {
@@ -1196,3 +1273,770 @@ func TestNegativePowerLevels(t *testing.T) {
 		t.Error("TestNegativePowerLevels should have succeeded but it didn't:", err)
 	}
 }
+
+func TestAuthRulesOrdering(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		eventJSON string
+		wantErr   string
+	}{
+		{
+			// Fails rule 1.1 (prev_events) and rule 1.2 (room ID domain).
+			name:      "create event with prev_events and wrong domain",
+			eventJSON: `{"type":"m.room.create","state_key":"","sender":"@u1:b","room_id":"!r1:a","event_id":"$e1:a","prev_events":[["$e0:a",{"sha256":"abc"}]],"content":{}}`,
+			wantErr:   "create event must be the first event in the room",
+		},
+		{
+			// Fails rule 1.2 (room ID domain) and rule 1.4 (no creator).
+			name:      "create event with wrong domain and no creator",
+			eventJSON: `{"type":"m.room.create","state_key":"","sender":"@u1:b","room_id":"!r1:a","event_id":"$e1:a","content":{}}`,
+			wantErr:   "create event room ID domain does not match sender",
+		},
+		{
+			// Fails rule 1.3 (room version) and rule 1.4 (no creator).
+			name:      "create event with unknown room version and no creator",
+			eventJSON: `{"type":"m.room.create","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e1:a","content":{"room_version":"unknown"}}`,
+			wantErr:   "create event has unrecognised room version",
+		},
+		{
+			// Fails rule 3 (create event for a different room) and rule 6 (sender not joined).
+			name:      "message in the wrong room from a non-member",
+			eventJSON: `{"type":"m.room.message","sender":"@u2:a","room_id":"!r2:a","event_id":"$e5:a","content":{}}`,
+			wantErr:   "create event has different roomID",
+		},
+		{
+			// Fails rule 3 (create event for a different room) and rule 5 (not the creator's first join).
+			name:      "membership in the wrong room",
+			eventJSON: `{"type":"m.room.member","state_key":"@u2:a","sender":"@u2:a","room_id":"!r2:a","event_id":"$e5:a","content":{"membership":"join"}}`,
+			wantErr:   "create event has different roomID",
+		},
+		{
+			// Fails rule 6 (sender not joined) and rule 8 (power level).
+			name:      "state event from a non-member",
+			eventJSON: `{"type":"m.room.topic","state_key":"","sender":"@u2:a","room_id":"!r1:a","event_id":"$e5:a","content":{}}`,
+			wantErr:   "not in room",
+		},
+		{
+			// Fails rule 8 (power level) and rule 9 (state_key belonging to another user).
+			name:      "low power user changing another user's state",
+			eventJSON: `{"type":"m.room.custom","state_key":"@u1:a","sender":"@u3:a","room_id":"!r1:a","event_id":"$e5:a","content":{}}`,
+			wantErr:   "is not allowed to send event",
+		},
+		{
+			// Fails rule 9 (state_key belonging to another user) only.
+			name:      "user changing another user's state",
+			eventJSON: `{"type":"m.room.custom","state_key":"@u3:a","sender":"@u1:a","room_id":"!r1:a","event_id":"$e5:a","content":{}}`,
+			wantErr:   "is not allowed to modify the state belonging to",
+		},
+		{
+			// Fails rule 8 (power level) and rule 10 (power level changes).
+			name:      "low power user changing power levels",
+			eventJSON: `{"type":"m.room.power_levels","state_key":"","sender":"@u3:a","room_id":"!r1:a","event_id":"$e5:a","content":{"users":{"@u3:a":100}}}`,
+			wantErr:   "is not allowed to send event",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := NewEventFromTrustedJSON([]byte(tc.eventJSON), false, RoomVersionV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Allowed(event, authRulesOrderingTestRoom)
+			if err == nil {
+				t.Fatalf("expected event to be rejected but it was allowed")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %q", tc.wantErr, err.Error())
+			}
+		})
+	}
+}
+
+var authRulesOrderingTestRoom = &testAuthEvents{
+	CreateJSON: json.RawMessage(`{
+		"type": "m.room.create",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e1:a",
+		"content": {
+			"creator": "@u1:a"
+		}
+	}`),
+	PowerLevelsJSON: json.RawMessage(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"content": {
+			"users": {
+				"@u1:a": 100
+			}
+		}
+	}`),
+	MemberJSON: map[string]json.RawMessage{
+		"@u1:a": json.RawMessage(`{
+			"type": "m.room.member",
+			"state_key": "@u1:a",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e2:a",
+			"content": {
+				"membership": "join"
+			}
+		}`),
+		"@u3:a": json.RawMessage(`{
+			"type": "m.room.member",
+			"state_key": "@u3:a",
+			"sender": "@u3:a",
+			"room_id": "!r1:a",
+			"event_id": "$e4:a",
+			"content": {
+				"membership": "join"
+			}
+		}`),
+	},
+}
+
+func TestAllowedLeaveAfterKnock(t *testing.T) {
+	testEventAllowed(t, `{
+		"auth_events": {
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a", "room_version": "7"}
+			},
+			"join_rules": {
+				"type": "m.room.join_rules",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e2:a",
+				"content": {"join_rule": "knock"}
+			},
+			"power_levels": {
+				"type": "m.room.power_levels",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e3:a",
+				"content": {
+					"kick": 50,
+					"users": {
+						"@u1:a": 100
+					}
+				}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e4:a",
+					"content": {"membership": "join"}
+				},
+				"@u2:a": {
+					"type": "m.room.member",
+					"sender": "@u2:a",
+					"room_id": "!r1:a",
+					"state_key": "@u2:a",
+					"event_id": "$e5:a",
+					"content": {"membership": "knock"}
+				},
+				"@u3:a": {
+					"type": "m.room.member",
+					"sender": "@u3:a",
+					"room_id": "!r1:a",
+					"state_key": "@u3:a",
+					"event_id": "$e6:a",
+					"content": {"membership": "join"}
+				}
+			}
+		},
+		"allowed": [{
+			"type": "m.room.member",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:a",
+			"event_id": "$e7:a",
+			"content": {"membership": "leave"},
+			"unsigned": {
+				"allowed": "A knocking user can retract their knock"
+			}
+		}, {
+			"type": "m.room.member",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:a",
+			"event_id": "$e8:a",
+			"content": {"membership": "leave"},
+			"unsigned": {
+				"allowed": "A user with kick power can reject a knock"
+			}
+		}],
+		"not_allowed": [{
+			"type": "m.room.member",
+			"sender": "@u3:a",
+			"room_id": "!r1:a",
+			"state_key": "@u2:a",
+			"event_id": "$e9:a",
+			"content": {"membership": "leave"},
+			"unsigned": {
+				"not_allowed": "A user without kick power cannot reject a knock"
+			}
+		}]
+	}`)
+}
+
+func TestSelectAuthEvents(t *testing.T) {
+	var state []*Event
+	for _, eventJSON := range []string{
+		`{"type":"m.room.create","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e1:a","content":{"creator":"@u1:a","room_version":"8"}}`,
+		`{"type":"m.room.join_rules","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e2:a","content":{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!space:a"}]}}`,
+		`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e3:a","content":{"invite":50,"users":{"@u1:a":100,"@u3:a":50}}}`,
+		`{"type":"m.room.member","state_key":"@u1:a","sender":"@u1:a","room_id":"!r1:a","event_id":"$e4:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@u2:a","sender":"@u2:a","room_id":"!r1:a","event_id":"$e5:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@u3:a","sender":"@u3:a","room_id":"!r1:a","event_id":"$e6:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.name","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e7:a","content":{"name":"test"}}`,
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, event)
+	}
+
+	tests := []struct {
+		name      string
+		eventType string
+		stateKey  string
+		sender    string
+		content   string
+		roomVer   RoomVersion
+		want      []int // indices into the state
+	}{
+		{
+			name:      "message event",
+			eventType: "m.room.message",
+			sender:    "@u2:a",
+			content:   `{"body":"hello"}`,
+			roomVer:   RoomVersionV8,
+			want:      []int{0, 2, 4},
+		},
+		{
+			name:      "restricted join",
+			eventType: MRoomMember,
+			stateKey:  "@new:b",
+			sender:    "@new:b",
+			content:   `{"membership":"join","join_authorised_via_users_server":"@u3:a"}`,
+			roomVer:   RoomVersionV8,
+			want:      []int{0, 1, 2, 5},
+		},
+		{
+			name:      "authorising user ignored without restricted joins",
+			eventType: MRoomMember,
+			stateKey:  "@new:b",
+			sender:    "@new:b",
+			content:   `{"membership":"join","join_authorised_via_users_server":"@u3:a"}`,
+			roomVer:   RoomVersionV7,
+			want:      []int{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authEvents, err := SelectAuthEvents(tt.eventType, tt.stateKey, tt.sender, json.RawMessage(tt.content), state, tt.roomVer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(authEvents))
+			for _, event := range authEvents {
+				got = append(got, event.EventID())
+			}
+			want := make([]string, 0, len(tt.want))
+			for _, i := range tt.want {
+				want = append(want, state[i].EventID())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got auth events %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAllowedRestrictedJoinAuthorisingUser(t *testing.T) {
+	var state []*Event
+	for _, eventJSON := range []string{
+		`{"type":"m.room.create","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e1:a","content":{"creator":"@u1:a","room_version":"8"}}`,
+		`{"type":"m.room.join_rules","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e2:a","content":{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!space:a"}]}}`,
+		`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e3:a","content":{"invite":0,"users":{"@u1:a":100}}}`,
+		// The content of auth events isn't checked beyond what the auth rules need.
+		`{"type":"m.room.member","state_key":"@u1:a","sender":"@u1:a","room_id":"!r1:a","event_id":"$e4:a","content":{"membership":"join","reason":123,"join_authorised_via_users_server":"@u1"}}`,
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, event)
+	}
+	authEvents := NewAuthEvents(state)
+
+	tests := []struct {
+		name    string
+		content string
+		allowed bool
+	}{
+		{"valid authorising user", `{"membership":"join","join_authorised_via_users_server":"@u1:a"}`, true},
+		{"non-string reason", `{"membership":"join","reason":123,"join_authorised_via_users_server":"@u1:a"}`, false},
+		{"authorising user without sigil", `{"membership":"join","join_authorised_via_users_server":"u1:a"}`, false},
+		{"authorising user without server", `{"membership":"join","join_authorised_via_users_server":"@u1"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := NewEventFromTrustedJSON([]byte(`{"type":"m.room.member","state_key":"@u2:b","sender":"@u2:b","room_id":"!r1:a","event_id":"$e6:a","content":`+tt.content+`}`), false, RoomVersionV8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Allowed(event, &authEvents)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected join to be allowed, got %s", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Fatalf("expected join to be rejected, but it was allowed")
+			}
+		})
+	}
+}
+
+func TestCanJoinRestricted(t *testing.T) {
+	var state []*Event
+	for _, eventJSON := range []string{
+		`{"type":"m.room.create","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e1:a","content":{"creator":"@u1:a","room_version":"8"}}`,
+		`{"type":"m.room.join_rules","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e2:a","content":{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!space:a"}]}}`,
+		`{"type":"m.room.power_levels","state_key":"","sender":"@u1:a","room_id":"!r1:a","event_id":"$e3:a","content":{"invite":50,"users":{"@u1:a":100,"@u3:a":50,"@u4:c":75}}}`,
+		`{"type":"m.room.member","state_key":"@u1:a","sender":"@u1:a","room_id":"!r1:a","event_id":"$e4:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@u2:a","sender":"@u2:a","room_id":"!r1:a","event_id":"$e5:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@u3:a","sender":"@u3:a","room_id":"!r1:a","event_id":"$e6:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@u4:c","sender":"@u4:c","room_id":"!r1:a","event_id":"$e7:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@banned:b","sender":"@u1:a","room_id":"!r1:a","event_id":"$e8:a","content":{"membership":"ban"}}`,
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, event)
+	}
+	isJoined := func(roomID, userID string) (bool, error) {
+		return roomID == "!space:a" && (userID == "@eligible:b" || userID == "@banned:b"), nil
+	}
+
+	tests := []struct {
+		name              string
+		userID            string
+		authorisingServer ServerName
+		allowed           bool
+		authorisingUser   string
+	}{
+		{"eligible user", "@eligible:b", "a", true, "@u1:a"},
+		{"authorising user from another server", "@eligible:b", "c", true, "@u4:c"},
+		{"ineligible user", "@ineligible:b", "a", false, ""},
+		{"banned user", "@banned:b", "a", false, ""},
+		{"joined user", "@u2:a", "a", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, authorisingUser, err := CanJoinRestricted(tt.userID, state, isJoined, tt.authorisingServer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tt.allowed || authorisingUser != tt.authorisingUser {
+				t.Fatalf("got allowed %v authorising user %q, want allowed %v authorising user %q", allowed, authorisingUser, tt.allowed, tt.authorisingUser)
+			}
+		})
+	}
+
+	// There is no user from the authorising server who can authorise the join.
+	if _, _, err := CanJoinRestricted("@eligible:b", state, isJoined, "d"); err == nil {
+		t.Fatalf("expected an error without a user from the authorising server")
+	}
+}
+
+var powerLevelChangeTestRoom = &testAuthEvents{
+	CreateJSON: json.RawMessage(`{
+		"type": "m.room.create",
+		"state_key": "",
+		"sender": "@u2:a",
+		"room_id": "!r1:a",
+		"event_id": "$e1:a",
+		"content": {
+			"room_version": "1"
+		}
+	}`),
+	PowerLevelsJSON: json.RawMessage(`{
+		"type": "m.room.power_levels",
+		"state_key": "",
+		"sender": "@u2:a",
+		"room_id": "!r1:a",
+		"event_id": "$e2:a",
+		"content": {
+			"state_default": 50,
+			"events_default": 0,
+			"users": {
+				"@u1:a": 50,
+				"@u2:a": 100,
+				"@u3:a": 10
+			}
+		}
+	}`),
+	MemberJSON: map[string]json.RawMessage{
+		"@u1:a": json.RawMessage(`{
+			"type": "m.room.member",
+			"state_key": "@u1:a",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e3:a",
+			"content": {
+				"membership": "join"
+			}
+		}`),
+	},
+}
+
+func TestPowerLevelChangesAboveSenderLevel(t *testing.T) {
+	// @u1:a has level 50, @u2:a has level 100 and @u3:a has level 10.
+	tests := []struct {
+		name    string
+		content string
+		allowed bool
+	}{{
+		name:    "unchanged levels",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 10}}`,
+		allowed: true,
+	}, {
+		name:    "raising events_default to own level",
+		content: `{"state_default": 50, "events_default": 50, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 10}}`,
+		allowed: true,
+	}, {
+		name:    "raising events_default above own level",
+		content: `{"state_default": 50, "events_default": 51, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 10}}`,
+	}, {
+		name:    "raising users_default above own level",
+		content: `{"state_default": 50, "events_default": 0, "users_default": 51, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 10}}`,
+	}, {
+		name:    "raising an event level above own level",
+		content: `{"state_default": 50, "events_default": 0, "events": {"m.room.name": 75}, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 10}}`,
+	}, {
+		name:    "promoting a user to own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 50}}`,
+		allowed: true,
+	}, {
+		name:    "promoting a user above own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 51}}`,
+	}, {
+		name:    "adding a user above own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 10, "@u4:a": 100}}`,
+	}, {
+		name:    "promoting self above own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 100, "@u2:a": 100, "@u3:a": 10}}`,
+	}, {
+		name:    "demoting self",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 0, "@u2:a": 100, "@u3:a": 10}}`,
+		allowed: true,
+	}, {
+		name:    "demoting a user below own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 100, "@u3:a": 0}}`,
+		allowed: true,
+	}, {
+		name:    "demoting a user above own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 10, "@u3:a": 10}}`,
+	}, {
+		name:    "removing a user above own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u3:a": 10}}`,
+	}, {
+		name:    "removing a user below own level",
+		content: `{"state_default": 50, "events_default": 0, "users": {"@u1:a": 50, "@u2:a": 100}}`,
+		allowed: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := NewEventFromTrustedJSON(RawJSON(`{
+				"type": "m.room.power_levels",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e4:a",
+				"content": `+tt.content+`
+			}`), false, RoomVersionV1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Allowed(event, powerLevelChangeTestRoom)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected power level change to be allowed, got %s", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Fatalf("expected power level change to be rejected, but it was allowed")
+			}
+		})
+	}
+}
+
+func TestValidateStateKey(t *testing.T) {
+	tests := []struct {
+		eventType string
+		stateKey  string
+		valid     bool
+	}{
+		{MRoomCreate, "", true},
+		{MRoomCreate, "@u1:a", false},
+		{MRoomPowerLevels, "", true},
+		{MRoomPowerLevels, "levels", false},
+		{MRoomJoinRules, "", true},
+		{MRoomJoinRules, "rules", false},
+		{MRoomMember, "@u1:a", true},
+		{MRoomMember, "", false},
+		{MRoomMember, "u1:a", false},
+		{MRoomThirdPartyInvite, "token", true},
+		{MRoomThirdPartyInvite, "", false},
+		{MRoomName, "", true},
+		{"m.custom.state", "anything", true},
+	}
+	for _, tt := range tests {
+		err := ValidateStateKey(tt.eventType, tt.stateKey)
+		if tt.valid && err != nil {
+			t.Errorf("expected %s state key %q to be valid, got %s", tt.eventType, tt.stateKey, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("expected %s state key %q to be rejected", tt.eventType, tt.stateKey)
+		}
+	}
+}
+
+func TestAllowedInitialPowerLevels(t *testing.T) {
+	testEventAllowed(t, `{
+		"auth_events": {
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a"}
+			},
+			"member": {
+				"@u1:a": {
+					"type": "m.room.member",
+					"sender": "@u1:a",
+					"room_id": "!r1:a",
+					"state_key": "@u1:a",
+					"event_id": "$e2:a",
+					"content": {"membership": "join"}
+				},
+				"@u2:a": {
+					"type": "m.room.member",
+					"sender": "@u2:a",
+					"room_id": "!r1:a",
+					"state_key": "@u2:a",
+					"event_id": "$e3:a",
+					"content": {"membership": "join"}
+				}
+			}
+		},
+		"allowed": [{
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e4:a",
+			"content": {
+				"users": {"@u1:a": 100},
+				"events": {"m.room.name": 50, "m.room.power_levels": 100},
+				"state_default": 50,
+				"users_default": 0
+			},
+			"unsigned": {
+				"allowed": "The creator can send the initial power levels"
+			}
+		}, {
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e5:a",
+			"content": {
+				"users": {"@u1:a": 100, "@u2:a": 100},
+				"users_default": 0
+			},
+			"unsigned": {
+				"allowed": "The creator can grant other users levels in the initial power levels"
+			}
+		}],
+		"not_allowed": [{
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"event_id": "$e6:a",
+			"content": {
+				"users": {"@u2:a": 100}
+			},
+			"unsigned": {
+				"not_allowed": "Only the creator has a high enough level before any power levels"
+			}
+		}, {
+			"type": "m.room.power_levels",
+			"state_key": "",
+			"sender": "@u1:a",
+			"room_id": "!r1:a",
+			"event_id": "$e7:a",
+			"content": {
+				"users": {"not_a_user_id": 100}
+			},
+			"unsigned": {
+				"not_allowed": "The users must be valid user IDs"
+			}
+		}]
+	}`)
+}
+
+func TestAllowedHistoryVisibility(t *testing.T) {
+	testEventAllowed(t, `{
+		"auth_events": {
+			"create": {
+				"type": "m.room.create",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e1:a",
+				"content": {"creator": "@u1:a"}
+			},
+			"power_levels": {
+				"type": "m.room.power_levels",
+				"state_key": "",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e2:a",
+				"content": {
+					"users": {"@u1:a": 100, "@u2:a": 50},
+					"users_default": 0,
+					"state_default": 50
+				}
+			},
+			"member": {
+				"@u2:a": {
+					"type": "m.room.member",
+					"sender": "@u2:a",
+					"room_id": "!r1:a",
+					"state_key": "@u2:a",
+					"event_id": "$e3:a",
+					"content": {"membership": "join"}
+				},
+				"@u3:a": {
+					"type": "m.room.member",
+					"sender": "@u3:a",
+					"room_id": "!r1:a",
+					"state_key": "@u3:a",
+					"event_id": "$e4:a",
+					"content": {"membership": "join"}
+				}
+			}
+		},
+		"allowed": [{
+			"type": "m.room.history_visibility",
+			"state_key": "",
+			"sender": "@u2:a",
+			"room_id": "!r1:a",
+			"event_id": "$e5:a",
+			"content": {"history_visibility": "joined"},
+			"unsigned": {
+				"allowed": "A moderator has the state default level"
+			}
+		}],
+		"not_allowed": [{
+			"type": "m.room.history_visibility",
+			"state_key": "",
+			"sender": "@u3:a",
+			"room_id": "!r1:a",
+			"event_id": "$e6:a",
+			"content": {"history_visibility": "world_readable"},
+			"unsigned": {
+				"not_allowed": "A regular user doesn't have the state default level"
+			}
+		}]
+	}`)
+}
+
+func TestCheckRedactionTarget(t *testing.T) {
+	redaction, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.redaction",
+		"sender": "@u1:a",
+		"room_id": "!r1:a",
+		"event_id": "$e3:a",
+		"redacts": "$e2:a",
+		"content": {}
+	}`), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		roomID string
+		valid  bool
+	}{{"!r1:a", true}, {"!r2:a", false}} {
+		target, err := NewEventFromTrustedJSON(RawJSON(`{
+			"type": "m.room.message",
+			"sender": "@u1:a",
+			"room_id": "`+tt.roomID+`",
+			"event_id": "$e2:a",
+			"content": {"body": "hello"}
+		}`), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = CheckRedactionTarget(redaction, target)
+		if tt.valid && err != nil {
+			t.Errorf("expected redaction of event in %s to be valid, got %s", tt.roomID, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("expected redaction of event in %s to be rejected", tt.roomID)
+		}
+	}
+}
+
+func TestCheckRedactsInContent(t *testing.T) {
+	// Room version 11 isn't implemented yet, so the events are parsed as
+	// room version 10 and checked as if "redacts" should be in the content.
+	tests := []struct {
+		name      string
+		redaction string
+		valid     bool
+	}{
+		{"redacts in content", `"content": {"redacts": "$e2:a"}`, true},
+		{"redacts only at top-level", `"redacts": "$e2:a", "content": {}`, false},
+		{"non-string redacts in content", `"content": {"redacts": 123}`, false},
+		{"invalid event ID in content", `"content": {"redacts": "e2"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := NewEventFromTrustedJSON(RawJSON(`{
+				"type": "m.room.redaction",
+				"sender": "@u1:a",
+				"room_id": "!r1:a",
+				"event_id": "$e3:a",
+				`+tt.redaction+`
+			}`), false, RoomVersionV10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkRedactsInContent(event)
+			if tt.valid && err != nil {
+				t.Fatalf("expected redaction to be valid, got %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatalf("expected redaction to be rejected")
+			}
+		})
+	}
+}
@@ -160,7 +160,8 @@ func NewMemberContentFromAuthEvents(authEvents AuthEventProvider, userID string)
 }
 
 // NewMemberContentFromEvent parse the member content from an event.
-// Returns an error if the content couldn't be parsed.
+// Returns an error if the content couldn't be parsed or if the "reason" is
+// not a string.
 func NewMemberContentFromEvent(event *Event) (c MemberContent, err error) {
 	if err = json.Unmarshal(event.Content(), &c); err != nil {
 		var partial membershipContent
@@ -168,12 +169,192 @@ func NewMemberContentFromEvent(event *Event) (c MemberContent, err error) {
 			err = errorf("unparsable member event content: %s", err.Error())
 			return
 		}
+		var reason struct {
+			Reason *string `json:"reason"`
+		}
+		if err = json.Unmarshal(event.Content(), &reason); err != nil {
+			err = errorf("member event content has a non-string 'reason'")
+			return
+		}
 		c.Membership = partial.Membership
 		c.ThirdPartyInvite = partial.ThirdPartyInvite
+		c.AuthorisedVia = partial.AuthorizedVia
+	}
+	return
+}
+
+// MembershipCounts counts the members of a room in each membership state from
+// the m.room.member events in the given current room state. Events that aren't
+// m.room.member state events, or that don't have a recognised membership, are
+// skipped.
+func MembershipCounts(state []*Event) (joined, invited, knocked, left, banned int) {
+	for _, event := range state {
+		if event == nil || event.Type() != MRoomMember {
+			continue
+		}
+		membership, err := event.Membership()
+		if err != nil {
+			continue
+		}
+		switch membership {
+		case Join:
+			joined++
+		case Invite:
+			invited++
+		case Knock:
+			knocked++
+		case Leave:
+			left++
+		case Ban:
+			banned++
+		}
+	}
+	return
+}
+
+// MaxSpaceChildOrderLength is the maximum length of the "order" of an
+// m.space.child event, in bytes.
+const MaxSpaceChildOrderLength = 50
+
+// SpaceChildContent is the JSON content of a m.space.child event.
+// See https://spec.matrix.org/v1.5/client-server-api/#mspacechild for descriptions of the fields.
+type SpaceChildContent struct {
+	Via       []string `json:"via"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
+
+// NewSpaceChildContentFromJSON parses the content of a m.space.child event.
+// An "order" which isn't a string, is longer than MaxSpaceChildOrderLength
+// bytes or contains characters outside of the range 0x20-0x7E is treated as
+// if it were absent, as required by the spec.
+// Returns an error if the content couldn't be parsed.
+func NewSpaceChildContentFromJSON(content []byte) (c SpaceChildContent, err error) {
+	var fields struct {
+		Via       []string `json:"via"`
+		Order     RawJSON  `json:"order"`
+		Suggested bool     `json:"suggested"`
+	}
+	if err = json.Unmarshal(content, &fields); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable m.space.child event content: %w", err)
+		return
+	}
+	c.Via = fields.Via
+	c.Suggested = fields.Suggested
+	var order string
+	if json.Unmarshal(fields.Order, &order) == nil && isValidSpaceChildOrder(order) {
+		c.Order = order
 	}
 	return
 }
 
+// isValidSpaceChildOrder returns true if the order is at most
+// MaxSpaceChildOrderLength bytes of printable ASCII.
+func isValidSpaceChildOrder(order string) bool {
+	if len(order) > MaxSpaceChildOrderLength {
+		return false
+	}
+	for i := 0; i < len(order); i++ {
+		if order[i] < 0x20 || order[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckRoomNameAndTopicLength checks that the "name" of an m.room.name event
+// or the "topic" of an m.room.topic event with the given content is at most
+// maxNameBytes or maxTopicBytes bytes long. A limit of zero or less disables
+// that check, and content for other event types is never rejected.
+//
+// The auth rules don't limit the length of either, so this must not be used
+// to reject events received over federation. It is an optional check that a
+// server can apply to events sent by its own users before building them.
+func CheckRoomNameAndTopicLength(eventType string, content []byte, maxNameBytes, maxTopicBytes int) error {
+	var key string
+	var limit int
+	switch eventType {
+	case MRoomName:
+		key, limit = "name", maxNameBytes
+	case MRoomTopic:
+		key, limit = "topic", maxTopicBytes
+	default:
+		return nil
+	}
+	if limit <= 0 {
+		return nil
+	}
+	var fields map[string]RawJSON
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return fmt.Errorf("gomatrixserverlib: unparsable %s event content: %w", eventType, err)
+	}
+	var value string
+	if err := json.Unmarshal(fields[key], &value); err != nil {
+		return nil // a missing or non-string value has no length to limit
+	}
+	if length := len(value); length > limit {
+		return EventValidationError{
+			Code:    EventValidationTooLarge,
+			Message: fmt.Sprintf("gomatrixserverlib: room %s is too long, length %d bytes > maximum %d bytes", key, length, limit),
+		}
+	}
+	return nil
+}
+
+// AvatarContent is the JSON content of a m.room.avatar event.
+// See https://spec.matrix.org/v1.5/client-server-api/#mroomavatar for descriptions of the fields.
+type AvatarContent struct {
+	// The mxc:// URI of the room avatar, or empty if the room has no avatar.
+	URL  string      `json:"url"`
+	Info *AvatarInfo `json:"info,omitempty"`
+}
+
+// AvatarInfo is the optional metadata about the image in a m.room.avatar event.
+type AvatarInfo struct {
+	Height   int64  `json:"h,omitempty"`
+	Width    int64  `json:"w,omitempty"`
+	MimeType string `json:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// NewAvatarContentFromJSON parses the content of a m.room.avatar event. A
+// missing or empty "url" means that the room has no avatar.
+// Returns an error if the content couldn't be parsed or if the "url" isn't a
+// well-formed mxc://server/mediaID URI.
+func NewAvatarContentFromJSON(content []byte) (c AvatarContent, err error) {
+	if err = json.Unmarshal(content, &c); err != nil {
+		err = fmt.Errorf("gomatrixserverlib: unparsable m.room.avatar event content: %w", err)
+		return
+	}
+	if c.URL != "" && !isValidMXCURI(c.URL) {
+		err = fmt.Errorf("gomatrixserverlib: m.room.avatar event has an invalid url %q", c.URL)
+		return
+	}
+	return
+}
+
+// isValidMXCURI returns true if the URI is of the form mxc://server/mediaID,
+// where the server is a valid server name and the media ID is made up of
+// only the characters A-Z, a-z, 0-9, '_' and '-'.
+func isValidMXCURI(uri string) bool {
+	if !strings.HasPrefix(uri, "mxc://") {
+		return false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "mxc://"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return false
+	}
+	if _, _, valid := ParseAndValidateServerName(ServerName(parts[0])); !valid {
+		return false
+	}
+	for _, r := range parts[1] {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
 // ThirdPartyInviteContent is the JSON content of a m.room.third_party_invite event needed for auth checks.
 // See https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-third-party-invite for descriptions of the fields.
 type ThirdPartyInviteContent struct {
@@ -224,6 +405,17 @@ const (
 	HistoryVisibilityJoined        HistoryVisibility = "joined"
 )
 
+// Validate checks that the history visibility is one of the values defined by
+// the spec. The auth rules don't reject unknown values, which are treated as
+// "shared" by clients and servers, so this should be used to check new
+// m.room.history_visibility events before they are sent.
+func (c HistoryVisibilityContent) Validate() error {
+	if _, ok := hisVisStringToIntMapping[c.HistoryVisibility]; !ok {
+		return fmt.Errorf("gomatrixserverlib: unknown history visibility %q", c.HistoryVisibility)
+	}
+	return nil
+}
+
 // Scan implements sql.Scanner
 func (h *HistoryVisibility) Scan(src interface{}) error {
 	switch v := src.(type) {
@@ -404,6 +596,22 @@ func (c *PowerLevelContent) Defaults() {
 	}
 }
 
+// DefaultPowerLevels returns the content of the initial m.room.power_levels
+// event for a new room of the given version, as created by the room creator.
+// The creator is given level 100 and all other levels take their spec
+// defaults. The "notifications" levels are left empty in room versions
+// whose auth rules don't cover them.
+func DefaultPowerLevels(roomVer RoomVersion, creatorUserID string) PowerLevelContent {
+	var c PowerLevelContent
+	c.Defaults()
+	c.Users = map[string]int64{creatorUserID: 100}
+	c.Events = map[string]int64{}
+	if notifs, err := roomVer.PowerLevelsIncludeNotifications(); err != nil || !notifs {
+		c.Notifications = map[string]int64{}
+	}
+	return c
+}
+
 // NewPowerLevelContentFromEvent loads the power level content from an event.
 func NewPowerLevelContentFromEvent(event *Event) (c PowerLevelContent, err error) {
 	// Set the levels to their default values.
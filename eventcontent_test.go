@@ -17,7 +17,9 @@ package gomatrixserverlib
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -174,3 +176,172 @@ func TestHistoryVisibility_Scan(t *testing.T) {
 		})
 	}
 }
+
+func TestDefaultPowerLevels(t *testing.T) {
+	for roomVersion := range RoomVersions() {
+		c := DefaultPowerLevels(roomVersion, "@creator:a")
+		if level := c.UserLevel("@creator:a"); level != 100 {
+			t.Errorf("room version %s: got creator level %d, want 100", roomVersion, level)
+		}
+		if level := c.UserLevel("@other:a"); level != 0 {
+			t.Errorf("room version %s: got other user level %d, want 0", roomVersion, level)
+		}
+		if c.StateDefault != 50 {
+			t.Errorf("room version %s: got state_default %d, want 50", roomVersion, c.StateDefault)
+		}
+		notifs, err := roomVersion.PowerLevelsIncludeNotifications()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.NotificationLevel("room"); notifs && got != 50 {
+			t.Errorf("room version %s: got room notification level %d, want 50", roomVersion, got)
+		}
+		if !notifs && len(c.Notifications) != 0 {
+			t.Errorf("room version %s: got notification levels %v, want none", roomVersion, c.Notifications)
+		}
+	}
+}
+
+func TestMembershipCounts(t *testing.T) {
+	memberEvents := []struct {
+		stateKey string
+		content  string
+	}{
+		{"@alice:a.com", `{"membership":"join"}`},
+		{"@bob:b.com", `{"membership":"join"}`},
+		{"@charlie:c.com", `{"membership":"join"}`},
+		{"@dave:b.com", `{"membership":"invite"}`},
+		{"@eve:c.com", `{"membership":"knock"}`},
+		{"@frank:a.com", `{"membership":"leave"}`},
+		{"@grace:b.com", `{"membership":"leave"}`},
+		{"@heidi:c.com", `{"membership":"ban"}`},
+		// Malformed member events are skipped.
+		{"@ivan:a.com", `{"membership":123}`},
+		{"@judy:b.com", `{"membership":"not-a-membership"}`},
+	}
+	var state []*Event
+	for i, m := range memberEvents {
+		event, err := NewEventFromTrustedJSON(RawJSON(fmt.Sprintf(`{
+			"type": "m.room.member",
+			"state_key": %q,
+			"sender": %q,
+			"room_id": "!r1:a.com",
+			"event_id": "$e%d:a.com",
+			"content": %s
+		}`, m.stateKey, m.stateKey, i, m.content)), false, RoomVersionV8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, event)
+	}
+	topic, err := NewEventFromTrustedJSON(RawJSON(`{
+		"type": "m.room.topic",
+		"state_key": "",
+		"sender": "@alice:a.com",
+		"room_id": "!r1:a.com",
+		"event_id": "$topic:a.com",
+		"content": {"topic": "hello"}
+	}`), false, RoomVersionV8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state = append(state, topic)
+
+	joined, invited, knocked, left, banned := MembershipCounts(state)
+	if joined != 3 || invited != 1 || knocked != 1 || left != 2 || banned != 1 {
+		t.Fatalf(
+			"got joined=%d invited=%d knocked=%d left=%d banned=%d, want joined=3 invited=1 knocked=1 left=2 banned=1",
+			joined, invited, knocked, left, banned,
+		)
+	}
+}
+
+func TestNewAvatarContentFromJSON(t *testing.T) {
+	content, err := NewAvatarContentFromJSON([]byte(`{
+		"url": "mxc://example.com/JWEIFJgwEIhweiWJE",
+		"info": {"h": 398, "w": 394, "mimetype": "image/jpeg", "size": 31037}
+	}`))
+	if err != nil {
+		t.Fatalf("expected valid avatar content to be parsed, got %s", err)
+	}
+	if content.URL != "mxc://example.com/JWEIFJgwEIhweiWJE" {
+		t.Fatalf("got url %q", content.URL)
+	}
+	wantInfo := AvatarInfo{Height: 398, Width: 394, MimeType: "image/jpeg", Size: 31037}
+	if content.Info == nil || *content.Info != wantInfo {
+		t.Fatalf("got info %+v, want %+v", content.Info, wantInfo)
+	}
+	marshalled, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `{"url":"mxc://example.com/JWEIFJgwEIhweiWJE","info":{"h":398,"w":394,"mimetype":"image/jpeg","size":31037}}`
+	if string(marshalled) != wantJSON {
+		t.Fatalf("got marshalled content %s, want %s", marshalled, wantJSON)
+	}
+
+	// Missing content means that the room has no avatar.
+	content, err = NewAvatarContentFromJSON([]byte(`{}`))
+	if err != nil {
+		t.Fatalf("expected empty avatar content to be parsed, got %s", err)
+	}
+	if content.URL != "" || content.Info != nil {
+		t.Fatalf("expected no avatar, got url %q info %+v", content.URL, content.Info)
+	}
+
+	for _, url := range []string{
+		"https://example.com/avatar.png",
+		"mxc://example.com",
+		"mxc://example.com/",
+		"mxc:///JWEIFJgwEIhweiWJE",
+		"mxc://example.com/media/id",
+		"mxc://not a server/JWEIFJgwEIhweiWJE",
+	} {
+		if _, err = NewAvatarContentFromJSON([]byte(`{"url":"` + url + `"}`)); err == nil {
+			t.Errorf("expected avatar url %q to be rejected", url)
+		}
+	}
+}
+
+func TestHistoryVisibilityContentValidate(t *testing.T) {
+	for _, visibility := range []HistoryVisibility{
+		HistoryVisibilityWorldReadable, HistoryVisibilityShared, HistoryVisibilityInvited, HistoryVisibilityJoined,
+	} {
+		if err := (HistoryVisibilityContent{HistoryVisibility: visibility}).Validate(); err != nil {
+			t.Errorf("expected history visibility %q to be valid, got %s", visibility, err)
+		}
+	}
+	for _, visibility := range []HistoryVisibility{"", "everyone", "Joined"} {
+		if err := (HistoryVisibilityContent{HistoryVisibility: visibility}).Validate(); err == nil {
+			t.Errorf("expected history visibility %q to be rejected", visibility)
+		}
+	}
+}
+
+func TestCheckRoomNameAndTopicLength(t *testing.T) {
+	for _, tc := range []struct {
+		eventType string
+		content   string
+		wantErr   bool
+	}{
+		{MRoomName, `{"name":"` + strings.Repeat("a", 10) + `"}`, false},
+		{MRoomName, `{"name":"` + strings.Repeat("a", 11) + `"}`, true},
+		// The limits count bytes, not characters.
+		{MRoomName, `{"name":"` + strings.Repeat("é", 6) + `"}`, true},
+		{MRoomTopic, `{"topic":"` + strings.Repeat("a", 20) + `"}`, false},
+		{MRoomTopic, `{"topic":"` + strings.Repeat("a", 21) + `"}`, true},
+		{MRoomTopic, `{"topic":42}`, false},
+		{"m.room.message", `{"body":"` + strings.Repeat("a", 100) + `"}`, false},
+	} {
+		err := CheckRoomNameAndTopicLength(tc.eventType, []byte(tc.content), 10, 20)
+		if tc.wantErr && err == nil {
+			t.Errorf("expected %s content %s to be rejected", tc.eventType, tc.content)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("expected %s content %s to be accepted, got %s", tc.eventType, tc.content, err)
+		}
+	}
+	if err := CheckRoomNameAndTopicLength(MRoomName, []byte(`{"name":"`+strings.Repeat("a", 100)+`"}`), 0, 0); err != nil {
+		t.Errorf("expected a zero limit to disable the check, got %s", err)
+	}
+}
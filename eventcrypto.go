@@ -22,6 +22,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
 
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
@@ -29,20 +30,40 @@ import (
 )
 
 func VerifyAllEventSignatures(ctx context.Context, events []*Event, verifier JSONVerifier) []error {
+	return verifyAllEventSignatures(ctx, events, verifier, false)
+}
+
+// verifyAllEventSignatures verifies the signatures of all of the events. If
+// trustEventIDs is true then the server of the event ID isn't required to
+// have signed events in room versions 1 and 2. This must only be used for
+// importing history, see WithRelaxedEventIDs.
+func verifyAllEventSignatures(ctx context.Context, events []*Event, verifier JSONVerifier, trustEventIDs bool) []error {
 	errors := make([]error, 0, len(events))
 	for _, e := range events {
-		errors = append(errors, e.VerifyEventSignatures(ctx, verifier))
+		errors = append(errors, e.verifyEventSignatures(ctx, verifier, trustEventIDs))
 	}
 	return errors
 }
 
-func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier) error {
+// SignaturesRequired returns the servers that must have signed the event for
+// it to pass signature checks, sorted by server name. This is always the
+// server of the sender, along with the origin and, in room versions 1 and 2,
+// the server that created the event ID. The invited server must sign invites,
+// and the authorising server must sign restricted joins.
+func (e *Event) SignaturesRequired() ([]ServerName, error) {
+	return e.signaturesRequired(false)
+}
+
+// signaturesRequired returns the servers that must have signed the event. If
+// trustEventIDs is true then the server that created the event ID is not
+// included in room versions 1 and 2, unless it is required for another reason.
+func (e *Event) signaturesRequired(trustEventIDs bool) ([]ServerName, error) {
 	needed := map[ServerName]struct{}{}
 
 	// The sender should have signed the event in all cases.
 	_, serverName, err := SplitID('@', e.Sender())
 	if err != nil {
-		return fmt.Errorf("failed to split sender: %w", err)
+		return nil, fmt.Errorf("failed to split sender: %w", err)
 	}
 	needed[serverName] = struct{}{}
 
@@ -57,11 +78,11 @@ func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier
 	// that created the event is included too. This is probably the
 	// same as the sender.
 	if format, err := e.roomVersion.EventIDFormat(); err != nil {
-		return fmt.Errorf("failed to get event ID format: %w", err)
-	} else if format == EventIDFormatV1 {
+		return nil, fmt.Errorf("failed to get event ID format: %w", err)
+	} else if format == EventIDFormatV1 && !trustEventIDs {
 		_, serverName, err = SplitID('$', e.EventID())
 		if err != nil {
-			return fmt.Errorf("failed to split event ID: %w", err)
+			return nil, fmt.Errorf("failed to split event ID: %w", err)
 		}
 		needed[serverName] = struct{}{}
 	}
@@ -70,32 +91,54 @@ func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier
 	if e.Type() == MRoomMember {
 		membership, err := e.Membership()
 		if err != nil {
-			return fmt.Errorf("failed to get membership of membership event: %w", err)
+			return nil, fmt.Errorf("failed to get membership of membership event: %w", err)
 		}
 
 		// For invites, the invited server should have signed the event.
 		if membership == Invite {
 			_, serverName, err = SplitID('@', *e.StateKey())
 			if err != nil {
-				return fmt.Errorf("failed to split state key: %w", err)
+				return nil, fmt.Errorf("failed to split state key: %w", err)
 			}
 			needed[serverName] = struct{}{}
 		}
 
 		// For restricted join rules, the authorising server should have signed.
 		if restricted, err := e.roomVersion.MayAllowRestrictedJoinsInEventAuth(); err != nil {
-			return fmt.Errorf("failed to check if restricted joins allowed: %w", err)
+			return nil, fmt.Errorf("failed to check if restricted joins allowed: %w", err)
 		} else if restricted && membership == Join {
 			if v := gjson.GetBytes(e.Content(), "join_authorised_via_users_server"); v.Exists() {
 				_, serverName, err = SplitID('@', v.String())
 				if err != nil {
-					return fmt.Errorf("failed to split authorised server: %w", err)
+					return nil, fmt.Errorf("failed to split authorised server: %w", err)
 				}
 				needed[serverName] = struct{}{}
 			}
 		}
 	}
 
+	servers := make([]ServerName, 0, len(needed))
+	for serverName := range needed {
+		servers = append(servers, serverName)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i] < servers[j]
+	})
+	return servers, nil
+}
+
+// VerifyEventSignatures checks that the event has been signed by all of the
+// servers returned by SignaturesRequired.
+func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier) error {
+	return e.verifyEventSignatures(ctx, verifier, false)
+}
+
+func (e *Event) verifyEventSignatures(ctx context.Context, verifier JSONVerifier, trustEventIDs bool) error {
+	needed, err := e.signaturesRequired(trustEventIDs)
+	if err != nil {
+		return err
+	}
+
 	strictValidityChecking, err := e.roomVersion.StrictValidityChecking()
 	if err != nil {
 		return fmt.Errorf("failed to check strict validity checking: %w", err)
@@ -107,7 +150,7 @@ func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier
 	}
 
 	var toVerify []VerifyJSONRequest
-	for serverName := range needed {
+	for _, serverName := range needed {
 		v := VerifyJSONRequest{
 			Message:                redactedJSON,
 			AtTS:                   e.OriginServerTS(),
@@ -134,13 +177,26 @@ func (e *Event) VerifyEventSignatures(ctx context.Context, verifier JSONVerifier
 // addContentHashesToEvent sets the "hashes" key of the event with a SHA-256 hash of the unredacted event content.
 // This hash is used to detect whether the unredacted content of the event is valid.
 // Returns the event JSON with a "hashes" key added to it.
-func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
+// In room versions that enforce canonical JSON, returns an error if the event
+// content isn't valid canonical JSON, since other servers would reject the event
+// for containing floats or integers outside of the canonical JSON range.
+func addContentHashesToEvent(eventJSON []byte, roomVersion RoomVersion) ([]byte, error) {
 	var event map[string]RawJSON
 
 	if err := json.Unmarshal(eventJSON, &event); err != nil {
 		return nil, err
 	}
 
+	enforceCanonicalJSON, err := roomVersion.EnforceCanonicalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if content, ok := event["content"]; ok && enforceCanonicalJSON {
+		if err = verifyEnforcedCanonicalJSON(content); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib: event content is not valid canonical JSON: %w", err)
+		}
+	}
+
 	unsignedJSON := event["unsigned"]
 	signatures := event["signatures"]
 
@@ -180,10 +236,14 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 
 // checkEventContentHash checks if the unredacted content of the event matches the SHA-256 hash under the "hashes" key.
 // Assumes that eventJSON has been canonicalised already.
+// Returns MissingContentHashError if there is no SHA-256 hash at all.
 func checkEventContentHash(eventJSON []byte) error {
 	var err error
 
 	result := gjson.GetBytes(eventJSON, "hashes.sha256")
+	if !result.Exists() {
+		return MissingContentHashError{}
+	}
 	var hash Base64Bytes
 	if err = hash.Decode(result.Str); err != nil {
 		return err
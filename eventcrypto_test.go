@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"sort"
 	"testing"
 
@@ -192,7 +193,7 @@ func TestSignEventTestVectors(t *testing.T) {
 	}
 
 	testSign := func(input string, want string) {
-		hashed, err := addContentHashesToEvent([]byte(input))
+		hashed, err := addContentHashesToEvent([]byte(input), RoomVersionV1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -476,3 +477,30 @@ func TestVerifyAllEventSignaturesForInvite(t *testing.T) {
 		t.Errorf("Verify server 1: got %s, want %s", servers[1], "bobserver")
 	}
 }
+
+func TestAddContentHashesRejectsNonCanonicalContent(t *testing.T) {
+	eventJSON := func(content string) []byte {
+		return []byte(`{
+			"room_id": "!x:domain",
+			"sender": "@a:domain",
+			"origin": "domain",
+			"origin_server_ts": 1000000,
+			"type": "m.room.message",
+			"content": ` + content + `
+		}`)
+	}
+	for _, content := range []string{`{"value":1.5}`, `{"nested":{"value":9007199254740992}}`} {
+		_, err := addContentHashesToEvent(eventJSON(content), RoomVersionV6)
+		if !errors.Is(err, ErrCanonicalJSON) {
+			t.Fatalf("expected content %s to be rejected as non-canonical, got %v", content, err)
+		}
+		// Room versions before 6 don't enforce canonical JSON.
+		if _, err = addContentHashesToEvent(eventJSON(content), RoomVersionV5); err != nil {
+			t.Fatalf("expected content %s to be accepted in room version 5, got %v", content, err)
+		}
+	}
+
+	if _, err := addContentHashesToEvent(eventJSON(`{"value": 15, "body": "1.5"}`), RoomVersionV6); err != nil {
+		t.Fatalf("expected canonical content to be accepted, got %v", err)
+	}
+}
@@ -306,6 +306,7 @@ type RoomVersionDescription struct {
 	enforceCanonicalJSON            bool
 	powerLevelsIncludeNotifications bool
 	requireIntegerPowerLevels       bool
+	redactsInContent                bool
 	Supported                       bool
 	Stable                          bool
 }
@@ -426,6 +427,17 @@ func (v RoomVersion) RequireIntegerPowerLevels() (bool, error) {
 	return false, UnsupportedRoomVersionError{v}
 }
 
+// RedactsInContent returns true if the given room version calls for the
+// "redacts" key of m.room.redaction events to be in the event content rather
+// than at the top level of the event, false otherwise. This is the case from
+// room version 11.
+func (v RoomVersion) RedactsInContent() (bool, error) {
+	if r, ok := roomVersionMeta[v]; ok {
+		return r.redactsInContent, nil
+	}
+	return false, UnsupportedRoomVersionError{v}
+}
+
 // UnsupportedRoomVersionError occurs when a call has been made with a room
 // version that is not supported by this version of gomatrixserverlib.
 type UnsupportedRoomVersionError struct {
@@ -4,6 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
@@ -473,6 +478,22 @@ func (ac *FederationClient) LookupProfile(
 	return
 }
 
+// Query performs a generic federation query of the given type, such as a
+// custom or experimental query type which doesn't have its own function here.
+// The response is returned as raw JSON for the caller to interpret.
+// Spec: https://matrix.org/docs/spec/server_server/r0.1.1.html#get-matrix-federation-v1-query-querytype
+func (ac *FederationClient) Query(
+	ctx context.Context, s ServerName, queryType string, args url.Values,
+) (res json.RawMessage, err error) {
+	path := federationPathPrefixV1 + "/query/" + url.PathEscape(queryType)
+	if len(args) > 0 {
+		path += "?" + args.Encode()
+	}
+	req := NewFederationRequest("GET", s, path)
+	err = ac.doRequest(ctx, req, &res)
+	return
+}
+
 // ClaimKeys claims E2E one-time keys from a remote server.
 // `oneTimeKeys` are the keys to be claimed. A map from user ID, to a map from device ID to algorithm name. E.g:
 //    {
@@ -567,6 +588,181 @@ func (ac *FederationClient) Backfill(
 	return
 }
 
+// DownloadMedia downloads a piece of media from a remote server using an
+// authenticated federation request. The response is a multipart/mixed body
+// with a JSON metadata part followed by the media itself. The returned
+// io.ReadCloser streams the media content and must be closed by the caller.
+// If the server redirects to another HTTPS URL instead of sending the media,
+// the media is downloaded from that URL and the returned metadata's Location is
+// set to it.
+// See https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediadownloadmediaid
+func (ac *FederationClient) DownloadMedia(
+	ctx context.Context, s ServerName, mediaID string,
+) (io.ReadCloser, MediaMetadata, error) {
+	path := federationPathPrefixV1 + "/media/download/" + url.PathEscape(mediaID)
+	r := NewFederationRequest("GET", s, path)
+	if err := r.Sign(ac.serverName, ac.serverKeyID, ac.serverPrivateKey); err != nil {
+		return nil, MediaMetadata{}, err
+	}
+	req, err := r.HTTPRequest()
+	if err != nil {
+		return nil, MediaMetadata{}, err
+	}
+	response, err := ac.DoHTTPRequest(ctx, req)
+	if err != nil {
+		return nil, MediaMetadata{}, err
+	}
+	if response.StatusCode/100 != 2 { // not 2xx
+		defer response.Body.Close() // nolint: errcheck
+		return nil, MediaMetadata{}, httpErrorFromResponse(req, response)
+	}
+	content, metadata, err := parseMultipartMediaResponse(response)
+	if err != nil {
+		response.Body.Close() // nolint: errcheck
+		return nil, MediaMetadata{}, err
+	}
+	if metadata.Location != "" {
+		response.Body.Close() // nolint: errcheck
+		return ac.followMediaRedirect(ctx, metadata.Location, metadata)
+	}
+	return content, metadata, nil
+}
+
+// parseMultipartMediaResponse reads the metadata part of a multipart media
+// response and returns a reader positioned at the start of the content part.
+// Closing the returned reader closes the response body. If the content part
+// is a redirect, the returned reader is nil and the metadata's Location is
+// set instead.
+func parseMultipartMediaResponse(response *http.Response) (io.ReadCloser, MediaMetadata, error) {
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: invalid media response content type: %w", err)
+	}
+	if mediaType != "multipart/mixed" {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: media response has content type %q, want multipart/mixed", mediaType)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: media response has no multipart boundary")
+	}
+	reader := multipart.NewReader(response.Body, boundary)
+
+	metadataPart, err := reader.NextPart()
+	if err != nil {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: failed to read media metadata part: %w", err)
+	}
+	var metadata MediaMetadata
+	if metadata.Metadata, err = readMediaMetadataPart(metadataPart); err != nil {
+		return nil, MediaMetadata{}, err
+	}
+
+	contentPart, err := reader.NextPart()
+	if err != nil {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: failed to read media content part: %w", err)
+	}
+	if metadata.Location = contentPart.Header.Get("Location"); metadata.Location != "" {
+		return nil, metadata, nil
+	}
+	if err = parseMediaContentHeaders(contentPart.Header, &metadata); err != nil {
+		return nil, MediaMetadata{}, err
+	}
+	return &multipartMediaContent{Reader: contentPart, body: response.Body}, metadata, nil
+}
+
+// parseMediaContentHeaders fills in the content type and disposition of the
+// metadata from the headers of the media content.
+func parseMediaContentHeaders(header textproto.MIMEHeader, metadata *MediaMetadata) error {
+	metadata.ContentType = header.Get("Content-Type")
+	if metadata.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(metadata.ContentType); err != nil {
+			return fmt.Errorf("gomatrixserverlib: invalid media content type %q: %w", metadata.ContentType, err)
+		}
+	}
+	metadata.ContentDisposition = header.Get("Content-Disposition")
+	if metadata.ContentDisposition != "" {
+		disposition, params, err := mime.ParseMediaType(metadata.ContentDisposition)
+		if err != nil {
+			return fmt.Errorf("gomatrixserverlib: invalid media content disposition %q: %w", metadata.ContentDisposition, err)
+		}
+		if disposition != "inline" && disposition != "attachment" {
+			return fmt.Errorf("gomatrixserverlib: media has unknown content disposition %q", disposition)
+		}
+		metadata.Disposition = disposition
+		metadata.Filename = params["filename"]
+	}
+	return nil
+}
+
+// followMediaRedirect downloads media from the URL that a remote server
+// redirected us to. The URL is not a matrix server, so the request is made
+// with the plain HTTP client rather than the federation transport and isn't
+// signed. Only HTTPS URLs are followed.
+func (ac *FederationClient) followMediaRedirect(ctx context.Context, location string, metadata MediaMetadata) (io.ReadCloser, MediaMetadata, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: invalid media redirect location %q: %w", location, err)
+	}
+	if u.Scheme != "https" {
+		return nil, MediaMetadata{}, fmt.Errorf("gomatrixserverlib: media redirect location %q is not an HTTPS URL", location)
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, MediaMetadata{}, err
+	}
+	if ac.userAgent != "" {
+		req.Header.Set("User-Agent", ac.userAgent)
+	}
+	response, err := ac.plainClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, MediaMetadata{}, err
+	}
+	if response.StatusCode/100 != 2 { // not 2xx
+		defer response.Body.Close() // nolint: errcheck
+		return nil, MediaMetadata{}, httpErrorFromResponse(req, response)
+	}
+	if err = parseMediaContentHeaders(textproto.MIMEHeader(response.Header), &metadata); err != nil {
+		response.Body.Close() // nolint: errcheck
+		return nil, MediaMetadata{}, err
+	}
+	return response.Body, metadata, nil
+}
+
+// readMediaMetadataPart reads the first part of a multipart media response,
+// which must be a JSON object. Servers don't always set a content type on
+// this part, so a missing one is allowed, but any other type than
+// application/json means that the metadata part is missing.
+func readMediaMetadataPart(part *multipart.Part) (RawJSON, error) {
+	if contentType := part.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib: invalid media metadata content type %q: %w", contentType, err)
+		}
+		if mediaType != "application/json" {
+			return nil, fmt.Errorf("gomatrixserverlib: media metadata part has content type %q, want application/json", mediaType)
+		}
+	}
+	var metadata RawJSON
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: failed to decode media metadata: %w", err)
+	}
+	var object map[string]RawJSON
+	if err := json.Unmarshal(metadata, &object); err != nil || object == nil {
+		return nil, fmt.Errorf("gomatrixserverlib: media metadata is not a JSON object")
+	}
+	return metadata, nil
+}
+
+// multipartMediaContent reads the content part of a multipart media
+// response and closes the underlying response body when closed.
+type multipartMediaContent struct {
+	io.Reader
+	body io.Closer
+}
+
+func (c *multipartMediaContent) Close() error {
+	return c.body.Close()
+}
+
 // MSC2836EventRelationships performs an MSC2836 /event_relationships request.
 func (ac *FederationClient) MSC2836EventRelationships(
 	ctx context.Context, dst ServerName, r MSC2836EventRelationshipsRequest, roomVersion RoomVersion,
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
@@ -147,3 +148,205 @@ func jsonify(x interface{}) string {
 	b, _ := json.Marshal(x)
 	return string(b)
 }
+
+// newMediaTestClient returns a federation client which responds to a media
+// download request for "abcdef" with the given multipart body. Requests to
+// https://media.example.com/media are answered with redirectedMediaContent.
+func newMediaTestClient(body string) *gomatrixserverlib.FederationClient {
+	serverName := gomatrixserverlib.ServerName("local.server.name")
+	keyID := gomatrixserverlib.KeyID("ed25519:auto")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	fc := gomatrixserverlib.NewFederationClient(
+		serverName, keyID, privateKey,
+		gomatrixserverlib.WithSkipVerify(true),
+	)
+	fc.Client = *gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(
+		&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host == "media.example.com" {
+					if req.URL.Scheme != "https" || req.URL.Path != "/media" {
+						return nil, fmt.Errorf("test: unexpected redirect url: %s", req.URL)
+					}
+					if req.Header.Get("Authorization") != "" {
+						return nil, fmt.Errorf("test: redirect request is signed")
+					}
+					if req.Header.Get("User-Agent") != "test-agent" {
+						return nil, fmt.Errorf("test: unexpected user agent: %s", req.Header.Get("User-Agent"))
+					}
+					return &http.Response{
+						StatusCode: 200,
+						Header: http.Header{
+							"Content-Type":        []string{"image/png"},
+							"Content-Disposition": []string{"inline"},
+						},
+						Body: ioutil.NopCloser(strings.NewReader(redirectedMediaContent)),
+					}, nil
+				}
+				if req.URL.Path != "/_matrix/federation/v1/media/download/abcdef" {
+					return nil, fmt.Errorf("test: unexpected url path: %s", req.URL.Path)
+				}
+				if !strings.HasPrefix(req.Header.Get("Authorization"), "X-Matrix ") {
+					return nil, fmt.Errorf("test: request is not signed")
+				}
+				return &http.Response{
+					StatusCode: 200,
+					Header: http.Header{
+						"Content-Type": []string{`multipart/mixed; boundary="boundary--in--header"`},
+					},
+					Body: ioutil.NopCloser(strings.NewReader(body)),
+				}, nil
+			},
+		},
+	))
+	fc.SetUserAgent("test-agent")
+	return fc
+}
+
+const redirectedMediaContent = "some redirected media bytes"
+
+func TestDownloadMedia(t *testing.T) {
+	mediaContent := "\r\n--not-the-boundary\r\nsome media bytes"
+	fc := newMediaTestClient("--boundary--in--header\r\n" +
+		"Content-Type: application/json; charset=utf-8\r\n\r\n" +
+		"{}\r\n" +
+		"--boundary--in--header\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=\"test.txt\"\r\n\r\n" +
+		mediaContent + "\r\n" +
+		"--boundary--in--header--\r\n",
+	)
+	content, metadata, err := fc.DownloadMedia(context.Background(), "target.server.name", "abcdef")
+	if err != nil {
+		t.Fatalf("DownloadMedia returned an error: %s", err)
+	}
+	defer content.Close() // nolint: errcheck
+	if string(metadata.Metadata) != "{}" {
+		t.Fatalf("DownloadMedia got metadata %q want %q", metadata.Metadata, "{}")
+	}
+	if metadata.ContentType != "text/plain" {
+		t.Fatalf("DownloadMedia got content type %q want %q", metadata.ContentType, "text/plain")
+	}
+	if metadata.Disposition != "attachment" || metadata.Filename != "test.txt" {
+		t.Fatalf("DownloadMedia got disposition %q filename %q", metadata.Disposition, metadata.Filename)
+	}
+	got, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatalf("failed to read media content: %s", err)
+	}
+	if string(got) != mediaContent {
+		t.Fatalf("DownloadMedia got content %q want %q", string(got), mediaContent)
+	}
+}
+
+func TestDownloadMediaMissingMetadata(t *testing.T) {
+	fc := newMediaTestClient("--boundary--in--header\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: inline\r\n\r\n" +
+		"some media bytes\r\n" +
+		"--boundary--in--header--\r\n",
+	)
+	content, _, err := fc.DownloadMedia(context.Background(), "target.server.name", "abcdef")
+	if err == nil {
+		content.Close() // nolint: errcheck
+		t.Fatalf("DownloadMedia expected an error for a response without a metadata part")
+	}
+}
+
+func TestDownloadMediaRedirect(t *testing.T) {
+	fc := newMediaTestClient("--boundary--in--header\r\n" +
+		"Content-Type: application/json\r\n\r\n" +
+		"{}\r\n" +
+		"--boundary--in--header\r\n" +
+		"Location: https://media.example.com/media\r\n\r\n" +
+		"\r\n" +
+		"--boundary--in--header--\r\n",
+	)
+	content, metadata, err := fc.DownloadMedia(context.Background(), "target.server.name", "abcdef")
+	if err != nil {
+		t.Fatalf("DownloadMedia returned an error: %s", err)
+	}
+	defer content.Close() // nolint: errcheck
+	if metadata.Location != "https://media.example.com/media" {
+		t.Fatalf("DownloadMedia got location %q want %q", metadata.Location, "https://media.example.com/media")
+	}
+	if metadata.ContentType != "image/png" || metadata.Disposition != "inline" {
+		t.Fatalf("DownloadMedia got content type %q disposition %q", metadata.ContentType, metadata.Disposition)
+	}
+	got, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatalf("failed to read media content: %s", err)
+	}
+	if string(got) != redirectedMediaContent {
+		t.Fatalf("DownloadMedia got content %q want %q", string(got), redirectedMediaContent)
+	}
+}
+
+func TestDownloadMediaRedirectInsecure(t *testing.T) {
+	fc := newMediaTestClient("--boundary--in--header\r\n" +
+		"Content-Type: application/json\r\n\r\n" +
+		"{}\r\n" +
+		"--boundary--in--header\r\n" +
+		"Location: http://media.example.com/media\r\n\r\n" +
+		"\r\n" +
+		"--boundary--in--header--\r\n",
+	)
+	content, _, err := fc.DownloadMedia(context.Background(), "target.server.name", "abcdef")
+	if err == nil {
+		content.Close() // nolint: errcheck
+		t.Fatalf("DownloadMedia expected an error for a redirect to a plain HTTP URL")
+	}
+}
+
+func TestDownloadMediaRedirectBadScheme(t *testing.T) {
+	fc := newMediaTestClient("--boundary--in--header\r\n" +
+		"Content-Type: application/json\r\n\r\n" +
+		"{}\r\n" +
+		"--boundary--in--header\r\n" +
+		"Location: file:///etc/passwd\r\n\r\n" +
+		"\r\n" +
+		"--boundary--in--header--\r\n",
+	)
+	content, _, err := fc.DownloadMedia(context.Background(), "target.server.name", "abcdef")
+	if err == nil {
+		content.Close() // nolint: errcheck
+		t.Fatalf("DownloadMedia expected an error for a redirect to a non-HTTPS URL")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	serverName := gomatrixserverlib.ServerName("local.server.name")
+	keyID := gomatrixserverlib.KeyID("ed25519:auto")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	fc := gomatrixserverlib.NewFederationClient(
+		serverName, keyID, privateKey,
+		gomatrixserverlib.WithSkipVerify(true),
+	)
+	fc.Client = *gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(
+		&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				if req.URL.Path != "/_matrix/federation/v1/query/org.example.custom" {
+					return nil, fmt.Errorf("test: unexpected url path: %s", req.URL.Path)
+				}
+				if got := req.URL.Query().Get("user_id"); got != "@alice:target.server.name" {
+					return nil, fmt.Errorf("test: unexpected user_id query param: %s", got)
+				}
+				if !strings.HasPrefix(req.Header.Get("Authorization"), "X-Matrix ") {
+					return nil, fmt.Errorf("test: request is not signed")
+				}
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"answer":42}`)),
+				}, nil
+			},
+		},
+	))
+	args := url.Values{}
+	args.Set("user_id", "@alice:target.server.name")
+	res, err := fc.Query(context.Background(), "target.server.name", "org.example.custom", args)
+	if err != nil {
+		t.Fatalf("Query returned an error: %s", err)
+	}
+	if string(res) != `{"answer":42}` {
+		t.Fatalf("Query got response %q want %q", string(res), `{"answer":42}`)
+	}
+}
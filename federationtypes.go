@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -514,7 +515,16 @@ func (r RespSendJoin) ToRespState() RespState {
 // This also checks that the join event is allowed by the state.
 // This function mutates the RespSendJoin to remove any events from
 // AuthEvents or StateEvents that do not have valid signatures.
+// Use CheckForRoom to also check that the response is for the room
+// that the caller asked to join.
 func (r *RespSendJoin) Check(ctx context.Context, roomVersion RoomVersion, keyRing JSONVerifier, joinEvent *Event, missingAuth AuthChainProvider) (*RespState, error) {
+	return r.CheckForRoom(ctx, roomVersion, keyRing, joinEvent.RoomID(), joinEvent, missingAuth)
+}
+
+// CheckForRoom performs the same checks as Check, and also checks that the
+// join event and the create event in the state are for the given room ID,
+// which should be the room that the caller asked to join.
+func (r *RespSendJoin) CheckForRoom(ctx context.Context, roomVersion RoomVersion, keyRing JSONVerifier, roomID string, joinEvent *Event, missingAuth AuthChainProvider) (*RespState, error) {
 	// First check that the state is valid and that the events in the response
 	// are correctly signed.
 	//
@@ -531,6 +541,16 @@ func (r *RespSendJoin) Check(ctx context.Context, roomVersion RoomVersion, keyRi
 	r.AuthEvents = rs.AuthEvents
 	r.StateEvents = rs.StateEvents
 
+	if err = ValidateJoinEventStructure(joinEvent, roomID); err != nil {
+		return nil, err
+	}
+
+	// Check that the state contains the create event for the room that we
+	// are trying to join, and that it agrees about the room version.
+	if err = checkSendJoinCreateEvent(stateEvents, roomID, roomVersion); err != nil {
+		return nil, err
+	}
+
 	eventsByID := map[string]*Event{}
 	authEventProvider := NewAuthEvents(nil)
 
@@ -575,6 +595,94 @@ func (r *RespSendJoin) Check(ctx context.Context, roomVersion RoomVersion, keyRi
 	return &rs, nil
 }
 
+// checkSendJoinCreateEvent checks that the given state contains exactly one
+// m.room.create event, that it is for the expected room ID and that the room
+// version it declares is the expected and supported room version.
+func checkSendJoinCreateEvent(stateEvents []*Event, roomID string, roomVersion RoomVersion) error {
+	var create *Event
+	for _, event := range stateEvents {
+		if event.Type() != MRoomCreate || !event.StateKeyEquals("") {
+			continue
+		}
+		if create != nil {
+			return fmt.Errorf("gomatrixserverlib: send_join response contains more than one create event")
+		}
+		create = event
+	}
+	if create == nil {
+		return fmt.Errorf("gomatrixserverlib: send_join response does not contain a create event")
+	}
+	if create.RoomID() != roomID {
+		return fmt.Errorf(
+			"gomatrixserverlib: send_join response create event is for room %q, expected %q",
+			create.RoomID(), roomID,
+		)
+	}
+	var content CreateContent
+	if err := json.Unmarshal(create.Content(), &content); err != nil {
+		return fmt.Errorf("gomatrixserverlib: send_join response create event has invalid content: %w", err)
+	}
+	// The room version is assumed to be "1" if it is not specified.
+	createRoomVersion := RoomVersionV1
+	if content.RoomVersion != nil {
+		createRoomVersion = *content.RoomVersion
+	}
+	if ver, ok := SupportedRoomVersions()[createRoomVersion]; !ok || !ver.Supported {
+		return UnsupportedRoomVersionError{
+			Version: createRoomVersion,
+		}
+	}
+	if createRoomVersion != roomVersion {
+		return fmt.Errorf(
+			"gomatrixserverlib: send_join response create event has room version %q, expected %q",
+			createRoomVersion, roomVersion,
+		)
+	}
+	return nil
+}
+
+// ValidateJoinEventStructure checks the structural constraints on a join event
+// that a joining server can check without knowing the state of the room. The
+// event must be a m.room.member join for its sender in the given room, and its
+// prev_events and auth_events must not be empty or refer to the join event
+// itself. It can't check that the prev_events are the forward extremities of
+// the resident server, since the joining server doesn't know those.
+func ValidateJoinEventStructure(joinEvent *Event, roomID string) error {
+	if joinEvent.RoomID() != roomID {
+		return fmt.Errorf(
+			"gomatrixserverlib: join event is for room %q, expected %q",
+			joinEvent.RoomID(), roomID,
+		)
+	}
+	if joinEvent.Type() != MRoomMember {
+		return fmt.Errorf("gomatrixserverlib: join event has type %q, expected %q", joinEvent.Type(), MRoomMember)
+	}
+	if !joinEvent.StateKeyEquals(joinEvent.Sender()) {
+		return fmt.Errorf("gomatrixserverlib: join event state key doesn't match sender %q", joinEvent.Sender())
+	}
+	membership, err := joinEvent.Membership()
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: join event has invalid membership: %w", err)
+	}
+	if membership != Join {
+		return fmt.Errorf("gomatrixserverlib: join event has membership %q, expected %q", membership, Join)
+	}
+	for kind, eventIDs := range map[string][]string{
+		"prev_events": joinEvent.PrevEventIDs(),
+		"auth_events": joinEvent.AuthEventIDs(),
+	} {
+		if len(eventIDs) == 0 {
+			return fmt.Errorf("gomatrixserverlib: join event has no %s", kind)
+		}
+		for _, eventID := range eventIDs {
+			if eventID == joinEvent.EventID() {
+				return fmt.Errorf("gomatrixserverlib: join event refers to itself in its %s", kind)
+			}
+		}
+	}
+	return nil
+}
+
 // A RespMakeLeave is the content of a response to GET /_matrix/federation/v2/make_leave/{roomID}/{userID}
 type RespMakeLeave struct {
 	// An incomplete m.room.member event for a user on the requesting server
@@ -603,6 +711,25 @@ type RespProfile struct {
 	AvatarURL   string `json:"avatar_url,omitempty"`
 }
 
+// MediaMetadata is the metadata of media downloaded from a remote server
+// with FederationClient.DownloadMedia.
+type MediaMetadata struct {
+	// The JSON object from the metadata part of the response.
+	Metadata RawJSON
+	// The Content-Type of the media, if given.
+	ContentType string
+	// The Content-Disposition of the media, if given.
+	ContentDisposition string
+	// The disposition type parsed from ContentDisposition, either "inline"
+	// or "attachment", or empty if no Content-Disposition was given.
+	Disposition string
+	// The filename parsed from ContentDisposition, if any.
+	Filename string
+	// The URL the media was downloaded from, if the remote server redirected
+	// to it instead of sending the media itself.
+	Location string
+}
+
 func checkAllowedByAuthEvents(event *Event, eventsByID map[string]*Event, missingAuth AuthChainProvider) error {
 	authEvents := NewAuthEvents(nil)
 
@@ -813,3 +940,46 @@ type MSC2946StrippedEvent struct {
 	Sender         string          `json:"sender"`
 	OriginServerTS Timestamp       `json:"origin_server_ts"`
 }
+
+// SortMSC2946ChildrenState sorts the m.space.child events of a space into
+// the order in which the children should be presented. Children are sorted
+// by their "order" first, with children that have no valid order after those
+// that do, then by the origin_server_ts of the event, then by the room ID in
+// the state key.
+// See https://spec.matrix.org/v1.5/client-server-api/#ordering-of-children-within-a-space
+func SortMSC2946ChildrenState(children []MSC2946StrippedEvent) {
+	orders := make([]string, len(children))
+	for i := range children {
+		if content, err := NewSpaceChildContentFromJSON(children[i].Content); err == nil {
+			orders[i] = content.Order
+		}
+	}
+	sort.Sort(msc2946ChildrenSorter{children, orders})
+}
+
+type msc2946ChildrenSorter struct {
+	children []MSC2946StrippedEvent
+	orders   []string
+}
+
+func (s msc2946ChildrenSorter) Len() int {
+	return len(s.children)
+}
+
+func (s msc2946ChildrenSorter) Less(i, j int) bool {
+	if s.orders[i] != s.orders[j] {
+		if s.orders[i] == "" || s.orders[j] == "" {
+			return s.orders[j] == ""
+		}
+		return s.orders[i] < s.orders[j]
+	}
+	if s.children[i].OriginServerTS != s.children[j].OriginServerTS {
+		return s.children[i].OriginServerTS < s.children[j].OriginServerTS
+	}
+	return s.children[i].StateKey < s.children[j].StateKey
+}
+
+func (s msc2946ChildrenSorter) Swap(i, j int) {
+	s.children[i], s.children[j] = s.children[j], s.children[i]
+	s.orders[i], s.orders[j] = s.orders[j], s.orders[i]
+}
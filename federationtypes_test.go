@@ -1,12 +1,14 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 	"testing"
 	"unicode"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/tidwall/sjson"
 )
 
 const emptyRespStateResponse = `{"pdus":[],"auth_chain":[]}`
@@ -159,3 +161,152 @@ func TestRespSendJoinMarshalJSONPartialState(t *testing.T) {
 		t.Errorf("json.Marshal(%+v):\n  wanted: '%s'\n     got: '%s'", input, wantJSON, got)
 	}
 }
+
+const testSendJoinCreateEvent = `{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`
+const testSendJoinJoinEvent = `{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"content":{"membership":"join"},"depth":1,"event_id":"$fnwGrQEpiOIUoDU2:baba.is.you","hashes":{"sha256":"DqOjdFgvFQ3V/jvQW2j3ygHL4D+t7/LaIPZ/tHTDZtI"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"qBWLb42zicQVsbh333YrcKpHfKokcUOM/ytldGlrgSdXqDEDDxvpcFlfadYnyvj3Z/GjA2XZkqKHanNEh575Bw"}},"state_key":"@userid:baba.is.you","type":"m.room.member"}`
+
+func TestRespSendJoinCheckCreateEvent(t *testing.T) {
+	joinEvent, err := NewEventFromTrustedJSON([]byte(testSendJoinJoinEvent), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := RespSendJoin{
+		StateEvents: EventJSONs{RawJSON(testSendJoinCreateEvent)},
+		AuthEvents:  EventJSONs{RawJSON(testSendJoinCreateEvent)},
+	}
+	if _, err = resp.Check(context.Background(), RoomVersionV1, &testNopJSONVerifier{}, joinEvent, nil); err != nil {
+		t.Fatalf("RespSendJoin.Check with a create event should have succeeded: %s", err)
+	}
+}
+
+func TestRespSendJoinCheckOtherRoom(t *testing.T) {
+	joinEvent, err := NewEventFromTrustedJSON([]byte(testSendJoinJoinEvent), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := RespSendJoin{
+		StateEvents: EventJSONs{RawJSON(testSendJoinCreateEvent)},
+		AuthEvents:  EventJSONs{RawJSON(testSendJoinCreateEvent)},
+	}
+	if _, err = resp.CheckForRoom(context.Background(), RoomVersionV1, &testNopJSONVerifier{}, "!roomid:baba.is.you", joinEvent, nil); err != nil {
+		t.Fatalf("RespSendJoin.CheckForRoom for the room of the join event should have succeeded: %s", err)
+	}
+	_, err = resp.CheckForRoom(context.Background(), RoomVersionV1, &testNopJSONVerifier{}, "!otherroom:baba.is.you", joinEvent, nil)
+	if err == nil {
+		t.Fatalf("RespSendJoin.CheckForRoom should have failed for a join event in another room")
+	}
+	if !strings.Contains(err.Error(), "join event is for room") {
+		t.Fatalf("RespSendJoin.CheckForRoom returned an unexpected error: %s", err)
+	}
+}
+
+func TestRespSendJoinCheckMissingCreateEvent(t *testing.T) {
+	joinEvent, err := NewEventFromTrustedJSON([]byte(testSendJoinJoinEvent), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := RespSendJoin{
+		StateEvents: EventJSONs{},
+		AuthEvents:  EventJSONs{RawJSON(testSendJoinCreateEvent)},
+	}
+	_, err = resp.Check(context.Background(), RoomVersionV1, &testNopJSONVerifier{}, joinEvent, nil)
+	if err == nil {
+		t.Fatalf("RespSendJoin.Check without a create event should have failed")
+	}
+	if !strings.Contains(err.Error(), "does not contain a create event") {
+		t.Fatalf("RespSendJoin.Check returned an unexpected error: %s", err)
+	}
+}
+
+func TestRespSendJoinCheckCreateEventWrongRoomVersion(t *testing.T) {
+	joinEvent, err := NewEventFromTrustedJSON([]byte(testSendJoinJoinEvent), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createEvent, err := NewEventFromTrustedJSON([]byte(testSendJoinCreateEvent), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkSendJoinCreateEvent([]*Event{createEvent}, joinEvent.RoomID(), RoomVersionV2); err == nil {
+		t.Fatalf("checkSendJoinCreateEvent should have failed for a mismatched room version")
+	}
+	if err = checkSendJoinCreateEvent([]*Event{createEvent, createEvent}, joinEvent.RoomID(), RoomVersionV1); err == nil {
+		t.Fatalf("checkSendJoinCreateEvent should have failed for multiple create events")
+	}
+}
+
+func TestValidateJoinEventStructure(t *testing.T) {
+	joinEvent, err := NewEventFromTrustedJSON([]byte(testSendJoinJoinEvent), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateJoinEventStructure(joinEvent, "!roomid:baba.is.you"); err != nil {
+		t.Fatalf("ValidateJoinEventStructure should have succeeded: %s", err)
+	}
+	if err = ValidateJoinEventStructure(joinEvent, "!otherroom:baba.is.you"); err == nil {
+		t.Fatalf("ValidateJoinEventStructure should have failed for a join event in another room")
+	}
+
+	selfReference := `["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"DqOjdFgvFQ3V/jvQW2j3ygHL4D+t7/LaIPZ/tHTDZtI"}]`
+	for _, key := range []string{"prev_events", "auth_events"} {
+		eventJSON, err := sjson.SetRawBytes([]byte(testSendJoinJoinEvent), key+".-1", []byte(selfReference))
+		if err != nil {
+			t.Fatal(err)
+		}
+		selfReferencingJoin, err := NewEventFromTrustedJSON(eventJSON, false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ValidateJoinEventStructure(selfReferencingJoin, "!roomid:baba.is.you")
+		if err == nil {
+			t.Fatalf("ValidateJoinEventStructure should have failed for a join event referring to itself in its %s", key)
+		}
+		if !strings.Contains(err.Error(), "refers to itself") {
+			t.Fatalf("ValidateJoinEventStructure returned an unexpected error: %s", err)
+		}
+	}
+}
+
+func TestSpaceChildOrder(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{`{"via":["a.com"],"order":"abc"}`, "abc"},
+		{`{"via":["a.com"],"order":"` + strings.Repeat("a", 50) + `"}`, strings.Repeat("a", 50)},
+		{`{"via":["a.com"],"order":"` + strings.Repeat("a", 51) + `"}`, ""},
+		{`{"via":["a.com"],"order":"ab\ncd"}`, ""},
+		{`{"via":["a.com"],"order":"café"}`, ""},
+		{`{"via":["a.com"],"order":12}`, ""},
+		{`{"via":["a.com"]}`, ""},
+	}
+	for _, tt := range tests {
+		content, err := NewSpaceChildContentFromJSON([]byte(tt.content))
+		if err != nil {
+			t.Fatalf("NewSpaceChildContentFromJSON(%s) returned an error: %s", tt.content, err)
+		}
+		if content.Order != tt.want {
+			t.Errorf("NewSpaceChildContentFromJSON(%s) got order %q want %q", tt.content, content.Order, tt.want)
+		}
+	}
+}
+
+func TestSortMSC2946ChildrenState(t *testing.T) {
+	children := []MSC2946StrippedEvent{
+		{StateKey: "!tooLong:a.com", OriginServerTS: 1, Content: json.RawMessage(`{"via":["a.com"],"order":"` + strings.Repeat("a", 51) + `"}`)},
+		{StateKey: "!illegal:a.com", OriginServerTS: 2, Content: json.RawMessage(`{"via":["a.com"],"order":"\u0001"}`)},
+		{StateKey: "!b:a.com", OriginServerTS: 3, Content: json.RawMessage(`{"via":["a.com"],"order":"b"}`)},
+		{StateKey: "!a:a.com", OriginServerTS: 4, Content: json.RawMessage(`{"via":["a.com"],"order":"a"}`)},
+		{StateKey: "!none2:a.com", OriginServerTS: 0, Content: json.RawMessage(`{"via":["a.com"]}`)},
+		{StateKey: "!none1:a.com", OriginServerTS: 0, Content: json.RawMessage(`{"via":["a.com"]}`)},
+	}
+	SortMSC2946ChildrenState(children)
+	want := []string{"!a:a.com", "!b:a.com", "!none1:a.com", "!none2:a.com", "!tooLong:a.com", "!illegal:a.com"}
+	got := make([]string, 0, len(children))
+	for _, child := range children {
+		got = append(got, child.StateKey)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("SortMSC2946ChildrenState mismatch (-want +got):\n%s", diff)
+	}
+}
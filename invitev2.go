@@ -1,8 +1,10 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/tidwall/gjson"
 )
@@ -80,6 +82,73 @@ func (i *InviteV2Request) InviteRoomState() []InviteV2StrippedState {
 	return i.fields.InviteRoomState
 }
 
+// CheckInvite checks that the invite event in the request is consistent with the
+// room version declared in the request. The event must parse as an event of the
+// declared room version, which is done when the request is unmarshalled, and the
+// signature of the sending server must be valid when verified according to that
+// room version. If the invite room state contains the m.room.create event then
+// the declared room version must also match the room version in its content.
+// This rejects events that are formatted for a different room version, e.g. a
+// room version 1 event that is declared as room version 6, since the redaction
+// and event ID rules differ between room versions and so the signatures won't
+// match.
+func CheckInvite(ctx context.Context, request *InviteV2Request, keyRing JSONVerifier) error {
+	event := request.Event()
+	if event == nil {
+		return errors.New("gomatrixserverlib: invite request doesn't contain event")
+	}
+	// If the invite room state includes the create event then the declared
+	// room version must be the one that the room was created with.
+	for _, state := range request.InviteRoomState() {
+		if state.Type() != MRoomCreate || state.StateKey() == nil || *state.StateKey() != "" {
+			continue
+		}
+		createVersion := RoomVersionV1 // rooms without a room_version are version 1
+		if v := gjson.GetBytes(state.Content(), "room_version"); v.Exists() {
+			createVersion = RoomVersion(v.String())
+		}
+		if createVersion != request.RoomVersion() {
+			return fmt.Errorf(
+				"gomatrixserverlib: invite declared room version %q does not match the create event room version %q",
+				request.RoomVersion(), createVersion,
+			)
+		}
+	}
+	if event.Type() != MRoomMember {
+		return fmt.Errorf("gomatrixserverlib: invite event has type %q, expected %q", event.Type(), MRoomMember)
+	}
+	// The invited server won't have signed the event yet, so only check the
+	// signature of the server that sent the invite.
+	_, senderServer, err := SplitID('@', event.Sender())
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: invite event has invalid sender: %w", err)
+	}
+	strictValidityChecking, err := request.RoomVersion().StrictValidityChecking()
+	if err != nil {
+		return err
+	}
+	redactedJSON, err := RedactEventJSON(event.JSON(), request.RoomVersion())
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to redact invite event: %w", err)
+	}
+	results, err := keyRing.VerifyJSONs(ctx, []VerifyJSONRequest{{
+		ServerName:             senderServer,
+		AtTS:                   event.OriginServerTS(),
+		Message:                redactedJSON,
+		StrictValidityChecking: strictValidityChecking,
+	}})
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to verify invite event: %w", err)
+	}
+	if results[0].Error != nil {
+		return fmt.Errorf(
+			"gomatrixserverlib: invite event %q is not valid for room version %q: %w",
+			event.EventID(), request.RoomVersion(), results[0].Error,
+		)
+	}
+	return nil
+}
+
 // InviteV2StrippedState is a cut-down set of fields from room state
 // events that allow the invited server to identify the room.
 type InviteV2StrippedState struct {
@@ -130,3 +199,35 @@ func (i *InviteV2StrippedState) Type() string {
 func (i *InviteV2StrippedState) Sender() string {
 	return i.fields.Sender
 }
+
+// StrippedState is a stripped state event, containing only the type,
+// state key, sender and content of the original state event. These are
+// used for the invite_room_state and knock_room_state.
+type StrippedState = InviteV2StrippedState
+
+// StrippedStateSelector selects which state events should be included
+// when stripping state with StripState. If StateKey is nil then all of
+// the state events with the given event type are selected.
+type StrippedStateSelector struct {
+	EventType string
+	StateKey  *string
+}
+
+// StripState returns the stripped versions of the state events that match
+// the given selectors. The stripped state events are returned in the order
+// of the selectors. Non-state events are ignored.
+func StripState(state []*Event, types []StrippedStateSelector) []StrippedState {
+	stripped := []StrippedState{}
+	for _, selector := range types {
+		for _, event := range state {
+			if event.StateKey() == nil || event.Type() != selector.EventType {
+				continue
+			}
+			if selector.StateKey != nil && !event.StateKeyEquals(*selector.StateKey) {
+				continue
+			}
+			stripped = append(stripped, NewInviteV2StrippedState(event))
+		}
+	}
+	return stripped
+}
@@ -1,8 +1,13 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 const TestInviteV2ExampleEvent = `{"_room_version":"1","auth_events":[["$oXL79cT7fFxR7dPH:localhost",{"sha256":"abjkiDSg1RkuZrbj2jZoGMlQaaj1Ue3Jhi7I7NlKfXY"}],["$IVUsaSkm1LBAZYYh:localhost",{"sha256":"X7RUj46hM/8sUHNBIFkStbOauPvbDzjSdH4NibYWnko"}],["$VS2QT0EeArZYi8wf:localhost",{"sha256":"k9eM6utkCH8vhLW9/oRsH74jOBS/6RVK42iGDFbylno"}]],"content":{"name":"test3"},"depth":7,"event_id":"$yvN1b43rlmcOs5fY:localhost","hashes":{"sha256":"Oh1mwI1jEqZ3tgJ+V1Dmu5nOEGpCE4RFUqyJv2gQXKs"},"origin":"localhost","origin_server_ts":1510854416361,"prev_events":[["$FqI6TVvWpcbcnJ97:localhost",{"sha256":"upCsBqUhNUgT2/+zkzg8TbqdQpWWKQnZpGJc6KcbUC4"}]],"prev_state":[],"room_id":"!19Mp0U9hjajeIiw1:localhost","sender":"@test:localhost","signatures":{"localhost":{"ed25519:u9kP":"5IzSuRXkxvbTp0vZhhXYZeOe+619iG3AybJXr7zfNn/4vHz4TH7qSJVQXSaHHvcTcDodAKHnTG1WDulgO5okAQ"}},"state_key":"","type":"m.room.name"}`
@@ -55,3 +60,157 @@ func TestStrippedState(t *testing.T) {
 		t.Fatalf("got %q, expected %q", string(j), expected)
 	}
 }
+
+func TestStripState(t *testing.T) {
+	mustParse := func(eventJSON string) *Event {
+		t.Helper()
+		ev, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	state := []*Event{
+		mustParse(`{"type":"m.room.create","state_key":"","sender":"@alice:a","room_id":"!r:a","event_id":"$create:a","depth":1,"origin":"a","hashes":{"sha256":"abc"},"signatures":{"a":{"ed25519:1":"sig"}},"content":{"creator":"@alice:a"}}`),
+		mustParse(`{"type":"m.room.power_levels","state_key":"","sender":"@alice:a","room_id":"!r:a","event_id":"$pl:a","content":{}}`),
+		mustParse(`{"type":"m.room.member","state_key":"@alice:a","sender":"@alice:a","room_id":"!r:a","event_id":"$alice:a","content":{"membership":"join"}}`),
+		mustParse(`{"type":"m.room.member","state_key":"@bob:b","sender":"@bob:b","room_id":"!r:a","event_id":"$bob:b","content":{"membership":"join"}}`),
+		mustParse(`{"type":"m.room.name","state_key":"","sender":"@alice:a","room_id":"!r:a","event_id":"$name:a","content":{"name":"test"}}`),
+	}
+	emptyStateKey := ""
+	inviter := "@alice:a"
+	stripped := StripState(state, []StrippedStateSelector{
+		{EventType: MRoomCreate, StateKey: &emptyStateKey},
+		{EventType: MRoomName, StateKey: &emptyStateKey},
+		{EventType: MRoomTopic, StateKey: &emptyStateKey},
+		{EventType: MRoomMember, StateKey: &inviter},
+	})
+	expected := []string{
+		`{"content":{"creator":"@alice:a"},"state_key":"","type":"m.room.create","sender":"@alice:a"}`,
+		`{"content":{"name":"test"},"state_key":"","type":"m.room.name","sender":"@alice:a"}`,
+		`{"content":{"membership":"join"},"state_key":"@alice:a","type":"m.room.member","sender":"@alice:a"}`,
+	}
+	if len(stripped) != len(expected) {
+		t.Fatalf("got %d stripped state events, expected %d", len(stripped), len(expected))
+	}
+	for i := range stripped {
+		j, err := json.Marshal(stripped[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(j) != expected[i] {
+			t.Fatalf("got %q, expected %q", string(j), expected[i])
+		}
+	}
+}
+
+// testInviteVerifier verifies JSON signatures using a single known key.
+type testInviteVerifier struct {
+	serverName ServerName
+	keyID      KeyID
+	publicKey  ed25519.PublicKey
+}
+
+func (v *testInviteVerifier) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	results := make([]VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		if req.ServerName != v.serverName {
+			results[i].Error = fmt.Errorf("unknown server %q", req.ServerName)
+			continue
+		}
+		results[i].Error = VerifyJSON(string(v.serverName), v.keyID, v.publicKey, req.Message)
+	}
+	return results, nil
+}
+
+func TestCheckInviteRoomVersion(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &testInviteVerifier{serverName: "a.com", keyID: "ed25519:test", publicKey: publicKey}
+	stateKey := "@bob:b.com"
+	eb := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &stateKey,
+		Depth:    1,
+	}
+	if err = eb.SetContent(map[string]interface{}{"membership": Invite}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := eb.Build(time.Now(), "a.com", "ed25519:test", privateKey, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		roomVersion RoomVersion
+		valid       bool
+	}{
+		{RoomVersionV1, true},
+		{RoomVersionV6, false},
+	} {
+		body := fmt.Sprintf(`{"room_version":%q,"invite_room_state":[],"event":%s}`, tc.roomVersion, event.JSON())
+		var request InviteV2Request
+		if err = json.Unmarshal([]byte(body), &request); err != nil {
+			t.Fatalf("failed to unmarshal invite request for room version %q: %s", tc.roomVersion, err)
+		}
+		err = CheckInvite(context.Background(), &request, verifier)
+		if tc.valid && err != nil {
+			t.Fatalf("expected invite declared as room version %q to be valid, got %s", tc.roomVersion, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("expected room version 1 invite declared as room version %q to be rejected", tc.roomVersion)
+		}
+	}
+}
+
+func TestCheckInviteCreateEventRoomVersion(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &testInviteVerifier{serverName: "a.com", keyID: "ed25519:test", publicKey: publicKey}
+	stateKey := "@bob:b.com"
+	eb := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &stateKey,
+		Depth:    1,
+	}
+	if err = eb.SetContent(map[string]interface{}{"membership": Invite}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := eb.Build(time.Now(), "a.com", "ed25519:test", privateKey, RoomVersionV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		createContent string
+		valid         bool
+	}{
+		{`{"creator":"@alice:a.com","room_version":"6"}`, true},
+		{`{"creator":"@alice:a.com","room_version":"7"}`, false},
+		{`{"creator":"@alice:a.com"}`, false},
+	} {
+		body := fmt.Sprintf(
+			`{"room_version":"6","invite_room_state":[{"type":"m.room.create","state_key":"","sender":"@alice:a.com","content":%s}],"event":%s}`,
+			tc.createContent, event.JSON(),
+		)
+		var request InviteV2Request
+		if err = json.Unmarshal([]byte(body), &request); err != nil {
+			t.Fatalf("failed to unmarshal invite request: %s", err)
+		}
+		err = CheckInvite(context.Background(), &request, verifier)
+		if tc.valid && err != nil {
+			t.Fatalf("expected invite with create content %s to be valid, got %s", tc.createContent, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("expected invite with create content %s to be rejected", tc.createContent)
+		}
+	}
+}
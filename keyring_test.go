@@ -1,10 +1,16 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 var privateKeySeed1 = `QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz/G5HE`
@@ -351,3 +357,174 @@ func (e *erroringKeyDatabase) StoreKeys(
 ) error {
 	return &testErrorStore
 }
+
+// testNotaryKeyClient returns the server keys from a notary response.
+type testNotaryKeyClient struct {
+	response []byte
+}
+
+func (c *testNotaryKeyClient) GetServerKeys(ctx context.Context, matrixServer ServerName) (ServerKeys, error) {
+	return ServerKeys{}, fmt.Errorf("not implemented")
+}
+
+func (c *testNotaryKeyClient) LookupServerKeys(
+	ctx context.Context, matrixServer ServerName, keyRequests map[PublicKeyLookupRequest]Timestamp,
+) ([]ServerKeys, error) {
+	var res NotaryServerKeys
+	if err := json.Unmarshal(c.response, &res); err != nil {
+		return nil, err
+	}
+	return res.ServerKeys, nil
+}
+
+func TestSignNotaryServerKeys(t *testing.T) {
+	originPublicKey, originPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notaryPublicKey, notaryPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the keys as published and signed by the origin server.
+	originKeys, err := json.Marshal(ServerKeyFields{
+		ServerName: "origin.com",
+		VerifyKeys: map[KeyID]VerifyKey{
+			"ed25519:origin": {Key: Base64Bytes(originPublicKey)},
+		},
+		ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	originKeys, err = SignJSON("origin.com", "ed25519:origin", originPrivateKey, originKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys ServerKeys
+	if err = json.Unmarshal(originKeys, &keys); err != nil {
+		t.Fatal(err)
+	}
+
+	notaryResponse, err := SignNotaryServerKeys([]ServerKeys{keys}, "notary.com", "ed25519:notary", notaryPrivateKey)
+	if err != nil {
+		t.Fatalf("SignNotaryServerKeys failed: %s", err)
+	}
+	if len(notaryResponse.ServerKeys) != 1 {
+		t.Fatalf("got %d server keys, want 1", len(notaryResponse.ServerKeys))
+	}
+	signed := notaryResponse.ServerKeys[0].Raw
+	if err = VerifyJSON("origin.com", "ed25519:origin", originPublicKey, signed); err != nil {
+		t.Errorf("origin signature is invalid: %s", err)
+	}
+	if err = VerifyJSON("notary.com", "ed25519:notary", notaryPublicKey, signed); err != nil {
+		t.Errorf("notary signature is invalid: %s", err)
+	}
+
+	// The response should be accepted by a perspective key fetcher which
+	// trusts the notary.
+	response, err := json.Marshal(notaryResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := PerspectiveKeyFetcher{
+		PerspectiveServerName: "notary.com",
+		PerspectiveServerKeys: map[KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey},
+		Client:                &testNotaryKeyClient{response: response},
+	}
+	request := PublicKeyLookupRequest{ServerName: "origin.com", KeyID: "ed25519:origin"}
+	results, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{
+		request: AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	result, ok := results[request]
+	if !ok {
+		t.Fatalf("FetchKeys did not return the origin key")
+	}
+	if !bytes.Equal(result.Key, originPublicKey) {
+		t.Fatalf("FetchKeys returned key %v, want %v", result.Key, originPublicKey)
+	}
+}
+
+// newDelegatedKeyServer starts a server which serves the given key response
+// for any host, and returns a client which delegates requests for a.example
+// to that server as if a.example's well-known pointed at b.example.
+func newDelegatedKeyServer(t *testing.T, keysJSON []byte) (*Client, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/key/v2/server" || r.Host != "b.example" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(keysJSON)
+	}))
+	tripper := newDestinationTripper(true, nil, false, true)
+	tripper.resolutionCache.Store(ServerName("a.example"), []ResolutionResult{{
+		Destination:   server.Listener.Addr().String(),
+		Host:          "b.example",
+		TLSServerName: "b.example",
+	}})
+	return NewClient(WithTransport(tripper)), server
+}
+
+func TestDirectKeyFetcherDelegatedServer(t *testing.T) {
+	publicKeyA, privateKeyA, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyB, privateKeyB, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedKeys := func(serverName ServerName, publicKey ed25519.PublicKey, privateKey ed25519.PrivateKey) []byte {
+		keys, err := json.Marshal(ServerKeyFields{
+			ServerName:   serverName,
+			VerifyKeys:   map[KeyID]VerifyKey{"ed25519:auto": {Key: Base64Bytes(publicKey)}},
+			ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, err = SignJSON(string(serverName), "ed25519:auto", privateKey, keys); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	request := PublicKeyLookupRequest{ServerName: "a.example", KeyID: "ed25519:auto"}
+
+	// The delegated host serves a.example's keys, which must be accepted.
+	client, server := newDelegatedKeyServer(t, signedKeys("a.example", publicKeyA, privateKeyA))
+	defer server.Close()
+	fetcher := DirectKeyFetcher{Client: client}
+	results, err := fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{
+		request: AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if result, ok := results[request]; !ok || !bytes.Equal(result.Key, publicKeyA) {
+		t.Fatalf("FetchKeys did not return the key for a.example, got %v", results)
+	}
+
+	// The delegated host serves its own keys, which must not be accepted as
+	// the keys of a.example.
+	client, server = newDelegatedKeyServer(t, signedKeys("b.example", publicKeyB, privateKeyB))
+	defer server.Close()
+	if _, err = client.GetServerKeys(context.Background(), "a.example"); err == nil {
+		t.Fatalf("GetServerKeys should have rejected the keys of the delegated host")
+	}
+	fetcher = DirectKeyFetcher{Client: client}
+	results, err = fetcher.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{
+		request: AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	if _, ok := results[request]; ok {
+		t.Fatalf("FetchKeys returned a key for a.example from the delegated host's keys")
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"encoding/json"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 // ServerKeys are the ed25519 signing keys published by a matrix server.
@@ -30,6 +32,40 @@ type ServerKeys struct {
 	ServerKeyFields
 }
 
+// NotaryServerKeys is the response body of the /_matrix/key/v2/query endpoint
+// of a notary server, as returned by SignNotaryServerKeys.
+type NotaryServerKeys struct {
+	ServerKeys []ServerKeys `json:"server_keys"`
+}
+
+// SignNotaryServerKeys adds the signature of a notary server to each of the
+// given server keys, producing the response body for the notary's
+// /_matrix/key/v2/query endpoint. The signatures of the origin servers are
+// preserved so that the keys can be verified by the requesting server against
+// both the origin and the notary.
+// See https://spec.matrix.org/v1.5/server-server-api/#querying-keys-through-another-server
+func SignNotaryServerKeys(
+	keys []ServerKeys, notaryName ServerName, keyID KeyID, privateKey ed25519.PrivateKey,
+) (NotaryServerKeys, error) {
+	res := NotaryServerKeys{ServerKeys: make([]ServerKeys, 0, len(keys))}
+	for _, k := range keys {
+		raw, err := k.MarshalJSON()
+		if err != nil {
+			return NotaryServerKeys{}, err
+		}
+		signed, err := SignJSON(string(notaryName), keyID, privateKey, raw)
+		if err != nil {
+			return NotaryServerKeys{}, err
+		}
+		var signedKeys ServerKeys
+		if err = json.Unmarshal(signed, &signedKeys); err != nil {
+			return NotaryServerKeys{}, err
+		}
+		res.ServerKeys = append(res.ServerKeys, signedKeys)
+	}
+	return res, nil
+}
+
 // A VerifyKey is a ed25519 public key for a server.
 type VerifyKey struct {
 	// The public key.
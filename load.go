@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+
+	"github.com/tidwall/gjson"
 )
 
 // EventLoadResult is the result of loading and verifying an event in the EventsLoader.
@@ -12,6 +14,12 @@ type EventLoadResult struct {
 	Event    *HeaderedEvent
 	Error    error
 	SoftFail bool
+	// ExtendsExtremity is true if one of the prev_events of the event is a
+	// forward extremity supplied with WithForwardExtremities or an event
+	// accepted earlier in the same batch, or false if the event forks the
+	// room DAG and creates a new forward extremity. It is always false if no
+	// forward extremities were supplied.
+	ExtendsExtremity bool
 }
 
 // EventsLoader loads untrusted events and verifies them.
@@ -24,17 +32,132 @@ type EventsLoader struct {
 	// 6. Passes authorization rules based on the current state of the room, otherwise it is "soft failed".
 	// This is only desirable for live events, not backfilled events hence the flag.
 	performSoftFailCheck bool
+	// Set to true to reject events whose room ID domain doesn't match the
+	// domain of the sender of the room's create event.
+	verifyRoomIDDomain bool
+	// Set to true to reject events whose room version doesn't match the room
+	// version declared by the room's create event.
+	verifyRoomVersion bool
+	// Set to true to reject events which have been signed by servers other
+	// than those returned by SignaturesRequired.
+	rejectUnexpectedSigners bool
+	// Set to true to trust the event IDs of events in room versions 1 and 2
+	// rather than requiring the server of the event ID to have signed them.
+	// This is unsafe for live federation and only exists to import history.
+	trustEventIDs bool
+	// The maximum content size in bytes for specific event types. Event
+	// types without an entry here are only subject to the overall event
+	// size limit.
+	contentSizeLimits map[string]int
+	// The current forward extremities of the room, used to determine the
+	// current state of the room for the soft-fail check and whether events
+	// extend an existing extremity.
+	forwardExtremities []string
+}
+
+// EventsLoaderOption can be supplied to NewEventsLoader to enable
+// additional checks that are not strictly required by the spec.
+type EventsLoaderOption func(*EventsLoader)
+
+// WithRoomIDMatchesCreatorCheck is an option that can be supplied to
+// NewEventsLoader. When enabled, events whose room ID domain does not
+// match the domain of the room's create event sender are rejected, as are
+// events for which no create event passes the signature and hash checks.
+// This is not required by the spec, but can help to detect spoofed rooms.
+func WithRoomIDMatchesCreatorCheck(enabled bool) EventsLoaderOption {
+	return func(l *EventsLoader) {
+		l.verifyRoomIDDomain = enabled
+	}
+}
+
+// WithRoomVersionMatchesCreateCheck is an option that can be supplied to
+// NewEventsLoader. When enabled, events are rejected with a RoomVersionErr if
+// the room version that the loader was created with doesn't match the room
+// version declared by the room's create event. Only create events that pass
+// the signature and hash checks are trusted, and events for which there is no
+// such create event aren't checked.
+func WithRoomVersionMatchesCreateCheck(enabled bool) EventsLoaderOption {
+	return func(l *EventsLoader) {
+		l.verifyRoomVersion = enabled
+	}
+}
+
+// WithUnexpectedSignerCheck is an option that can be supplied to
+// NewEventsLoader. When enabled, events which carry signatures from servers
+// that had no reason to sign them, i.e. servers not returned by
+// SignaturesRequired, are rejected with an UnexpectedSignerErr. Extra
+// signatures are harmless to the spec's checks, so by default they are
+// tolerated.
+func WithUnexpectedSignerCheck(enabled bool) EventsLoaderOption {
+	return func(l *EventsLoader) {
+		l.rejectUnexpectedSigners = enabled
+	}
+}
+
+// WithRelaxedEventIDs is an option that can be supplied to NewEventsLoader.
+// When enabled, the event IDs of events in room versions 1 and 2 are trusted
+// as provided, and the server named in the event ID is no longer required to
+// have signed the event. The sender, origin and any other servers that must
+// sign the event are still checked. Room versions 3 and later derive event
+// IDs from the event hash, so this has no effect on them.
+//
+// Some old versions of Synapse generated event IDs that don't match the
+// server that signed the event, so archives of legacy rooms can contain
+// events which will otherwise fail signature checks. This option only exists
+// to allow importing such archives.
+//
+// WARNING: This is unsafe for live federation. A server could claim any
+// event ID for the events that it sends, including event IDs that belong to
+// other servers, and events with colliding event IDs would be accepted. Never
+// enable this for events received over federation in normal operation.
+func WithRelaxedEventIDs(enabled bool) EventsLoaderOption {
+	return func(l *EventsLoader) {
+		l.trustEventIDs = enabled
+	}
+}
+
+// WithContentSizeLimit is an option that can be supplied to NewEventsLoader.
+// Events of the given type whose content is larger than maxBytes are rejected,
+// even if they are within the overall event size limit. By default there are
+// no limits for any event types. This can be supplied more than once to set
+// limits for different event types.
+func WithContentSizeLimit(eventType string, maxBytes int) EventsLoaderOption {
+	return func(l *EventsLoader) {
+		if l.contentSizeLimits == nil {
+			l.contentSizeLimits = make(map[string]int)
+		}
+		l.contentSizeLimits[eventType] = maxBytes
+	}
+}
+
+// WithForwardExtremities is an option that can be supplied to NewEventsLoader
+// with the current forward extremities of the room. The loader uses these to
+// determine whether each event extends an existing extremity, which is
+// reported in EventLoadResult.ExtendsExtremity. If the soft-fail check is
+// enabled, the current state of the room is calculated from the state after
+// these extremities, and events which are not allowed by the current state
+// are soft-failed. LoadAndVerify returns an error if there is no state after
+// the extremities to check against.
+func WithForwardExtremities(eventIDs []string) EventsLoaderOption {
+	return func(l *EventsLoader) {
+		l.forwardExtremities = eventIDs
+	}
 }
 
-// NewEventsLoader returns a new events loader
-func NewEventsLoader(roomVer RoomVersion, keyRing JSONVerifier, stateProvider StateProvider, provider AuthChainProvider, performSoftFailCheck bool) *EventsLoader {
-	return &EventsLoader{
+// NewEventsLoader returns a new events loader. You can supply zero or
+// more EventsLoaderOptions to enable optional checks.
+func NewEventsLoader(roomVer RoomVersion, keyRing JSONVerifier, stateProvider StateProvider, provider AuthChainProvider, performSoftFailCheck bool, options ...EventsLoaderOption) *EventsLoader {
+	l := &EventsLoader{
 		roomVer:              roomVer,
 		keyRing:              keyRing,
 		provider:             provider,
 		stateProvider:        stateProvider,
 		performSoftFailCheck: performSoftFailCheck,
 	}
+	for _, option := range options {
+		option(l)
+	}
+	return l
 }
 
 // LoadAndVerify loads untrusted events and verifies them.
@@ -56,6 +179,10 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 			errs = append(errs, err)
 			continue
 		}
+		if err = l.checkContentSize(event); err != nil {
+			errs = append(errs, err)
+			continue
+		}
 		events = append(events, event)
 	}
 
@@ -73,10 +200,34 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 	// so we can directly index from events into results from now on.
 
 	// 2. Passes signature checks, otherwise it is dropped.
-	failures := VerifyAllEventSignatures(ctx, events, l.keyRing)
+	failures := verifyAllEventSignatures(ctx, events, l.keyRing, l.trustEventIDs)
 	if len(failures) != len(events) {
 		return nil, fmt.Errorf("gomatrixserverlib: bulk event signature verification length mismatch: %d != %d", len(failures), len(events))
 	}
+	// If there is more than one create event for a room then the one that
+	// the other events refer to in their auth events is used, or otherwise
+	// the first one in topological order. The others are rejected below.
+	referenced := make(map[string]bool)
+	for i, event := range events {
+		if failures[i] == nil {
+			for _, authEventID := range event.AuthEventIDs() {
+				referenced[authEventID] = true
+			}
+		}
+	}
+	verifiedCreates := make(map[string]*Event)
+	for i, event := range events {
+		if failures[i] == nil && !event.Redacted() && event.Type() == MRoomCreate && event.StateKeyEquals("") {
+			if create, ok := verifiedCreates[event.RoomID()]; !ok || (!referenced[create.EventID()] && referenced[event.EventID()]) {
+				verifiedCreates[event.RoomID()] = event
+			}
+		}
+	}
+	roomVersions := make(map[string]RoomVersion)
+	eventsByID := make(map[string]*Event, len(events))
+	for _, event := range events {
+		eventsByID[event.EventID()] = event
+	}
 	for i := range events {
 		h := events[i].Headered(l.roomVer)
 		results[i] = EventLoadResult{
@@ -88,6 +239,36 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 				continue
 			}
 		}
+		if l.rejectUnexpectedSigners {
+			if err := checkUnexpectedSigners(events[i]); err != nil {
+				if results[i].Error == nil { // could have failed earlier
+					results[i].Error = UnexpectedSignerErr{err}
+					continue
+				}
+			}
+		}
+		if l.verifyRoomIDDomain {
+			if err := l.checkRoomIDMatchesCreator(ctx, events[i], verifiedCreates); err != nil {
+				if results[i].Error == nil { // could have failed earlier
+					results[i].Error = err
+					continue
+				}
+			}
+		}
+		if l.verifyRoomVersion {
+			if err := l.checkRoomVersionMatchesCreate(ctx, events[i], verifiedCreates, roomVersions); err != nil {
+				if results[i].Error == nil { // could have failed earlier
+					results[i].Error = RoomVersionErr{err}
+					continue
+				}
+			}
+		}
+		if err := checkSingleCreateEvent(events[i], verifiedCreates); err != nil {
+			if results[i].Error == nil { // could have failed earlier
+				results[i].Error = AuthRulesErr{err}
+				continue
+			}
+		}
 		// 4. Passes authorization rules based on the event's auth events, otherwise it is rejected.
 		if err := VerifyEventAuthChain(ctx, h, l.provider); err != nil {
 			if results[i].Error == nil { // could have failed earlier
@@ -103,12 +284,361 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 				continue
 			}
 		}
+
+		// The target of a redaction can only be checked if it is known, so
+		// only check redactions whose target is in the same batch.
+		if events[i].Type() == MRoomRedaction {
+			if target, ok := eventsByID[events[i].Redacts()]; ok {
+				if err := CheckRedactionTarget(events[i], target); err != nil {
+					if results[i].Error == nil { // could have failed earlier
+						results[i].Error = AuthRulesErr{err}
+						continue
+					}
+				}
+			}
+		}
 	}
 
-	// TODO: performSoftFailCheck, needs forward extremity
+	if len(l.forwardExtremities) > 0 {
+		if err := l.checkForwardExtremities(ctx, results); err != nil {
+			return nil, err
+		}
+	}
 	return results, nil
 }
 
+// checkForwardExtremities sets ExtendsExtremity on the results of the events
+// that passed the other checks and, if enabled, performs the soft-fail check
+// against the current state of the room at the forward extremities. The
+// results must be in topological order. Events that are accepted become
+// forward extremities themselves and, if they are state events, update the
+// current state for the events after them.
+func (l *EventsLoader) checkForwardExtremities(ctx context.Context, results []EventLoadResult) error {
+	extremities := make(map[string]struct{}, len(l.forwardExtremities))
+	for _, eventID := range l.forwardExtremities {
+		extremities[eventID] = struct{}{}
+	}
+	var currentState *AuthEvents
+	var currentRoomID string
+	for i := range results {
+		if results[i].Error != nil || results[i].Event == nil {
+			continue
+		}
+		event := results[i].Event.Unwrap()
+		for _, prevEventID := range event.PrevEventIDs() {
+			if _, ok := extremities[prevEventID]; ok {
+				results[i].ExtendsExtremity = true
+				break
+			}
+		}
+
+		// 6. Passes authorization rules based on the current state of the room, otherwise it is "soft failed".
+		if !l.performSoftFailCheck {
+			extremities[event.EventID()] = struct{}{}
+			continue
+		}
+		if currentState == nil {
+			state, err := l.currentState(ctx)
+			if err != nil {
+				return fmt.Errorf("gomatrixserverlib: failed to calculate current state for soft-fail check: %w", err)
+			}
+			if len(state) == 0 {
+				return fmt.Errorf("gomatrixserverlib: no current state at the forward extremities for soft-fail check")
+			}
+			authEvents := NewAuthEvents(state)
+			currentState = &authEvents
+			currentRoomID = state[0].RoomID()
+		}
+		if event.RoomID() != currentRoomID {
+			// The forward extremities are for a different room.
+			continue
+		}
+		// The state before a create event is always empty, so the auth rules
+		// can't reject a second create event for a room. It mustn't replace
+		// the create event in the current state though, so soft-fail it.
+		if event.Type() == MRoomCreate && event.StateKeyEquals("") {
+			create, err := currentState.Create()
+			if err != nil {
+				return err
+			}
+			if create != nil && create.EventID() != event.EventID() {
+				results[i].SoftFail = true
+				continue
+			}
+		}
+		if err := Allowed(event, currentState); err != nil {
+			results[i].SoftFail = true
+			continue
+		}
+		// The event has been accepted, so later events in the batch can
+		// build on it and have to be checked against the state after it.
+		extremities[event.EventID()] = struct{}{}
+		if event.StateKey() != nil {
+			if err := currentState.AddEvent(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// currentState returns the state of the room after the forward extremities.
+// If there is more than one forward extremity then the state after each of
+// them is resolved together.
+func (l *EventsLoader) currentState(ctx context.Context) ([]*Event, error) {
+	if l.provider == nil {
+		return nil, fmt.Errorf("no provider to fetch the forward extremities with")
+	}
+	extremities, err := l.provider(l.roomVer, l.forwardExtremities)
+	if err != nil {
+		return nil, err
+	}
+	var stateSets [][]*Event
+	for _, extremity := range extremities {
+		if extremity == nil {
+			continue
+		}
+		h := extremity.Headered(l.roomVer)
+		stateIDs, err := l.stateProvider.StateIDsBeforeEvent(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		stateBefore, err := l.stateProvider.StateBeforeEvent(ctx, l.roomVer, h, stateIDs)
+		if err != nil {
+			return nil, err
+		}
+		state := make([]*Event, 0, len(stateBefore)+1)
+		for _, stateEvent := range stateBefore {
+			if stateEvent.StateKey() != nil && extremity.StateKey() != nil &&
+				stateEvent.Type() == extremity.Type() && *stateEvent.StateKey() == *extremity.StateKey() {
+				continue // replaced by the extremity
+			}
+			state = append(state, stateEvent)
+		}
+		if extremity.StateKey() != nil {
+			state = append(state, extremity)
+		}
+		stateSets = append(stateSets, state)
+	}
+	switch len(stateSets) {
+	case 0:
+		return nil, fmt.Errorf("no forward extremities found")
+	case 1:
+		return stateSets[0], nil
+	}
+	seen := make(map[string]struct{})
+	var allState []*Event
+	for _, state := range stateSets {
+		for _, stateEvent := range state {
+			if _, ok := seen[stateEvent.EventID()]; ok {
+				continue
+			}
+			seen[stateEvent.EventID()] = struct{}{}
+			allState = append(allState, stateEvent)
+		}
+	}
+	authEvents, err := l.authChain(allState)
+	if err != nil {
+		return nil, err
+	}
+	return ResolveConflicts(l.roomVer, allState, authEvents)
+}
+
+// authChain returns the full auth chain of the given events, fetching the
+// auth events from the provider.
+func (l *EventsLoader) authChain(events []*Event) ([]*Event, error) {
+	seen := make(map[string]struct{})
+	var need []string
+	for _, event := range events {
+		need = append(need, event.AuthEventIDs()...)
+	}
+	var authChain []*Event
+	for len(need) > 0 {
+		var fetch []string
+		for _, eventID := range need {
+			if _, ok := seen[eventID]; !ok {
+				seen[eventID] = struct{}{}
+				fetch = append(fetch, eventID)
+			}
+		}
+		if len(fetch) == 0 {
+			break
+		}
+		authEvents, err := l.provider(l.roomVer, fetch)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib: failed to obtain auth events: %w", err)
+		}
+		need = need[:0]
+		for _, authEvent := range authEvents {
+			if authEvent == nil {
+				continue // the provider may return partial results
+			}
+			authChain = append(authChain, authEvent)
+			need = append(need, authEvent.AuthEventIDs()...)
+		}
+	}
+	return authChain, nil
+}
+
+// checkContentSize checks that the content of the event is within the
+// limit configured for the event type, if there is one.
+func (l *EventsLoader) checkContentSize(event *Event) error {
+	maxBytes, ok := l.contentSizeLimits[event.Type()]
+	if !ok {
+		return nil
+	}
+	if size := len(event.Content()); size > maxBytes {
+		return EventValidationError{
+			Code:    EventValidationTooLarge,
+			Message: fmt.Sprintf("gomatrixserverlib: %s event content is too long, length %d bytes > maximum %d bytes", event.Type(), size, maxBytes),
+		}
+	}
+	return nil
+}
+
+// checkUnexpectedSigners checks that the event has only been signed by the
+// servers that are required to sign it.
+func checkUnexpectedSigners(event *Event) error {
+	required, err := event.SignaturesRequired()
+	if err != nil {
+		return err
+	}
+	expected := make(map[string]struct{}, len(required))
+	for _, serverName := range required {
+		expected[string(serverName)] = struct{}{}
+	}
+	var unexpected []string
+	gjson.GetBytes(event.JSON(), "signatures").ForEach(func(key, _ gjson.Result) bool {
+		if _, ok := expected[key.Str]; !ok {
+			unexpected = append(unexpected, key.Str)
+		}
+		return true
+	})
+	if len(unexpected) > 0 {
+		return fmt.Errorf("gomatrixserverlib: event %s has unexpected signatures from %s", event.EventID(), strings.Join(unexpected, ", "))
+	}
+	return nil
+}
+
+// verifiedCreateEventFor returns the create event for the room of the given
+// event. creates contains the verified create events from the same batch and
+// these are preferred, otherwise the provider is asked for the auth events of
+// the event. A create event from the provider is only returned if it passes
+// the signature and hash checks, in which case it is added to creates for the
+// rest of the batch. Returns nil if there is no verified create event
+// available.
+func (l *EventsLoader) verifiedCreateEventFor(ctx context.Context, event *Event, creates map[string]*Event) (*Event, error) {
+	if create, ok := creates[event.RoomID()]; ok || l.provider == nil {
+		return create, nil
+	}
+	authEvents, err := l.provider(l.roomVer, event.AuthEventIDs())
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: failed to obtain create event for %s: %w", event.EventID(), err)
+	}
+	for _, authEvent := range authEvents {
+		if authEvent == nil || authEvent.Type() != MRoomCreate || !authEvent.StateKeyEquals("") {
+			continue
+		}
+		// A redacted create event has failed its hash check.
+		if authEvent.Redacted() {
+			return nil, nil
+		}
+		if failures := verifyAllEventSignatures(ctx, []*Event{authEvent}, l.keyRing, l.trustEventIDs); failures[0] != nil {
+			return nil, nil
+		}
+		creates[event.RoomID()] = authEvent
+		return authEvent, nil
+	}
+	return nil, nil
+}
+
+// checkRoomVersionMatchesCreate checks that the event is being loaded with
+// the room version declared by the room's create event. Only create events
+// whose signatures and content hashes have been verified are trusted, see
+// verifiedCreateEventFor. The room versions that have been found are
+// remembered in roomVersions for the rest of the batch. Events for which
+// there is no verified create event available are not checked.
+func (l *EventsLoader) checkRoomVersionMatchesCreate(
+	ctx context.Context, event *Event, creates map[string]*Event, roomVersions map[string]RoomVersion,
+) error {
+	roomVersion, ok := roomVersions[event.RoomID()]
+	if !ok {
+		create, err := l.verifiedCreateEventFor(ctx, event, creates)
+		if err != nil {
+			return err
+		}
+		if create == nil {
+			return nil
+		}
+		authEvents := NewAuthEvents([]*Event{create})
+		content, err := NewCreateContentFromAuthEvents(&authEvents)
+		if err != nil {
+			return fmt.Errorf("gomatrixserverlib: failed to parse create event for %s: %w", event.EventID(), err)
+		}
+		roomVersion = RoomVersionV1
+		if content.RoomVersion != nil {
+			roomVersion = *content.RoomVersion
+		}
+		roomVersions[event.RoomID()] = roomVersion
+	}
+	if roomVersion != l.roomVer {
+		return fmt.Errorf(
+			"gomatrixserverlib: event %s is being loaded as room version %q but the create event declares room version %q",
+			event.EventID(), l.roomVer, roomVersion,
+		)
+	}
+	return nil
+}
+
+// checkSingleCreateEvent rejects a create event if a different create event
+// is known for the room. The auth rules only reject a create event that has
+// prev_events, so they can't stop a second create event from being injected
+// as a fake root of the room.
+func checkSingleCreateEvent(event *Event, creates map[string]*Event) error {
+	if event.Type() != MRoomCreate || !event.StateKeyEquals("") {
+		return nil
+	}
+	if create, ok := creates[event.RoomID()]; ok && create.EventID() != event.EventID() {
+		return fmt.Errorf("gomatrixserverlib: room %s already has create event %s, rejecting %s", event.RoomID(), create.EventID(), event.EventID())
+	}
+	return nil
+}
+
+// checkRoomIDMatchesCreator performs the verifyRoomIDMatchesCreator check
+// against the verified create event for the room of the given event.
+func (l *EventsLoader) checkRoomIDMatchesCreator(ctx context.Context, event *Event, creates map[string]*Event) error {
+	create, err := l.verifiedCreateEventFor(ctx, event, creates)
+	if err != nil {
+		return err
+	}
+	return verifyRoomIDMatchesCreator(event, create)
+}
+
+// verifyRoomIDMatchesCreator checks that the domain of the event's room ID
+// matches the domain of the sender of the room's create event. Whilst not
+// strictly required, the server part of a room ID should match the server
+// that created the room in normal cases.
+func verifyRoomIDMatchesCreator(event, create *Event) error {
+	if create == nil {
+		return fmt.Errorf("gomatrixserverlib: no create event found for event %s", event.EventID())
+	}
+	roomIDDomain, err := domainFromID(event.RoomID())
+	if err != nil {
+		return err
+	}
+	creatorDomain, err := domainFromID(create.Sender())
+	if err != nil {
+		return err
+	}
+	if roomIDDomain != creatorDomain {
+		return fmt.Errorf(
+			"gomatrixserverlib: event %s room ID domain does not match create event sender domain: %q != %q",
+			event.EventID(), roomIDDomain, creatorDomain,
+		)
+	}
+	return nil
+}
+
 type SignatureErr struct {
 	err error
 }
@@ -121,6 +651,36 @@ func (se SignatureErr) Is(target error) bool {
 	return strings.HasPrefix(target.Error(), "SignatureErr")
 }
 
+// UnexpectedSignerErr is the error for events rejected by the check enabled
+// with WithUnexpectedSignerCheck. Unlike SignatureErr, the signatures that the
+// event needs are valid, so this is a deliberate rejection and not a sign that
+// a key has changed.
+type UnexpectedSignerErr struct {
+	err error
+}
+
+func (se UnexpectedSignerErr) Error() string {
+	return fmt.Sprintf("UnexpectedSignerErr: %s", se.err)
+}
+
+func (se UnexpectedSignerErr) Is(target error) bool {
+	return strings.HasPrefix(target.Error(), "UnexpectedSignerErr")
+}
+
+// RoomVersionErr is the error for events rejected by the check enabled with
+// WithRoomVersionMatchesCreateCheck.
+type RoomVersionErr struct {
+	err error
+}
+
+func (se RoomVersionErr) Error() string {
+	return fmt.Sprintf("RoomVersionErr: %s", se.err)
+}
+
+func (se RoomVersionErr) Is(target error) bool {
+	return strings.HasPrefix(target.Error(), "RoomVersionErr")
+}
+
 type AuthChainErr struct {
 	err error
 }
@@ -0,0 +1,922 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/sjson"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testAuthStateProvider returns the auth events of an event as the state
+// before that event, so that auth rules are always satisfied at state. If
+// room is set then the state events are looked up in that room.
+type testAuthStateProvider struct {
+	room *testLoaderRoom
+}
+
+func (p *testAuthStateProvider) StateIDsBeforeEvent(ctx context.Context, event *HeaderedEvent) ([]string, error) {
+	return event.AuthEventIDs(), nil
+}
+
+func (p *testAuthStateProvider) StateBeforeEvent(ctx context.Context, roomVer RoomVersion, event *HeaderedEvent, eventIDs []string) (map[string]*Event, error) {
+	if p.room == nil {
+		return nil, nil
+	}
+	events, err := p.room.provider(roomVer, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]*Event, len(events))
+	for _, event := range events {
+		state[event.EventID()] = event
+	}
+	return state, nil
+}
+
+type testLoaderRoom struct {
+	t       *testing.T
+	roomVer RoomVersion
+	origin  ServerName
+	key     ed25519.PrivateKey
+	depth   int64
+	events  []*Event
+}
+
+func newTestLoaderRoom(t *testing.T, roomVer RoomVersion, origin ServerName) *testLoaderRoom {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	return &testLoaderRoom{
+		t:       t,
+		roomVer: roomVer,
+		origin:  origin,
+		key:     key,
+	}
+}
+
+// build creates and signs a new event which references every state event
+// created so far as its auth events and the last event as its prev event,
+// unless the builder already has auth events or prev events.
+func (r *testLoaderRoom) build(eb EventBuilder) *Event {
+	r.t.Helper()
+	authEvents := []string{}
+	prevEvents := []string{}
+	for _, ev := range r.events {
+		if ev.StateKey() != nil {
+			authEvents = append(authEvents, ev.EventID())
+		}
+	}
+	if len(r.events) > 0 {
+		prevEvents = append(prevEvents, r.events[len(r.events)-1].EventID())
+	}
+	if eb.AuthEvents == nil {
+		eb.AuthEvents = authEvents
+	}
+	if eb.PrevEvents == nil {
+		eb.PrevEvents = prevEvents
+	}
+	eb.Depth = r.depth
+	ev, err := eb.Build(time.Now(), r.origin, "ed25519:test", r.key, r.roomVer)
+	if err != nil {
+		r.t.Fatalf("failed to build event: %s", err)
+	}
+	r.depth++
+	r.events = append(r.events, ev)
+	return ev
+}
+
+func (r *testLoaderRoom) provider(roomVer RoomVersion, eventIDs []string) ([]*Event, error) {
+	var result []*Event
+	for _, id := range eventIDs {
+		for _, ev := range r.events {
+			if ev.EventID() == id {
+				result = append(result, ev)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (r *testLoaderRoom) rawEvents() []json.RawMessage {
+	raw := make([]json.RawMessage, 0, len(r.events))
+	for _, ev := range r.events {
+		raw = append(raw, ev.JSON())
+	}
+	return raw
+}
+
+func mustBuilderContent(t *testing.T, eb *EventBuilder, content interface{}) {
+	t.Helper()
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+}
+
+func createTestLoaderRoom(t *testing.T, roomID, creator string) *testLoaderRoom {
+	room := newTestLoaderRoom(t, RoomVersionV10, "a.com")
+	emptyStateKey := ""
+	create := EventBuilder{
+		Sender:   creator,
+		RoomID:   roomID,
+		Type:     MRoomCreate,
+		StateKey: &emptyStateKey,
+	}
+	mustBuilderContent(t, &create, map[string]interface{}{
+		"creator":      creator,
+		"room_version": RoomVersionV10,
+	})
+	room.build(create)
+	return room
+}
+
+func TestLoaderRoomIDMatchesCreator(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithRoomIDMatchesCreatorCheck(true),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Error != nil {
+		t.Fatalf("got error %s, want none", results[0].Error)
+	}
+}
+
+func TestLoaderRoomIDMismatchedCreator(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:b.com", "@alice:a.com")
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithRoomIDMatchesCreatorCheck(true),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Error == nil {
+		t.Fatalf("expected an error for mismatched room ID domain, got none")
+	}
+	if results[0].Event == nil || results[0].Event.EventID() != room.events[0].EventID() {
+		t.Fatalf("expected the rejected event to be returned with its error")
+	}
+}
+
+func TestLoaderRoomIDMatchesUnverifiedCreator(t *testing.T) {
+	// The create event is from b.com to match the room ID, but the signature
+	// of b.com can't be verified.
+	room := newTestLoaderRoom(t, RoomVersionV10, "b.com")
+	emptyStateKey := ""
+	create := EventBuilder{
+		Sender:   "@eve:b.com",
+		RoomID:   "!room:b.com",
+		Type:     MRoomCreate,
+		StateKey: &emptyStateKey,
+	}
+	mustBuilderContent(t, &create, map[string]interface{}{
+		"creator":      "@eve:b.com",
+		"room_version": RoomVersionV10,
+	})
+	room.build(create)
+	room.origin = "a.com"
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:b.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+	loader := NewEventsLoader(
+		RoomVersionV10, &testServerJSONVerifier{servers: []ServerName{"a.com"}}, &testAuthStateProvider{}, room.provider, false,
+		WithRoomIDMatchesCreatorCheck(true),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if _, ok := results[0].Error.(SignatureErr); !ok {
+		t.Fatalf("expected create event to fail signature checks, got %v", results[0].Error)
+	}
+	if results[1].Error == nil || !strings.Contains(results[1].Error.Error(), "no create event found") {
+		t.Fatalf("expected join event to be rejected without a verified create event, got %v", results[1].Error)
+	}
+}
+
+func TestLoaderContentSizeLimit(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+		"custom":     strings.Repeat("a", 2048),
+	})
+	room.build(join)
+
+	// Without a limit the oversized member event is accepted.
+	loader := NewEventsLoader(RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false)
+	results, err := loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			t.Fatalf("got error %s, want none", result.Error)
+		}
+	}
+
+	// With a limit the oversized member event is rejected but the create event is not.
+	loader = NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithContentSizeLimit(MRoomMember, 1024),
+	)
+	results, err = loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Error != nil || results[0].Event.Type() != MRoomCreate {
+		t.Fatalf("expected create event to be accepted, got %+v", results[0])
+	}
+	var validationErr EventValidationError
+	if !errors.As(results[1].Error, &validationErr) || validationErr.Code != EventValidationTooLarge {
+		t.Fatalf("expected oversized member event to be rejected as too large, got %v", results[1].Error)
+	}
+}
+
+func TestLoaderUnexpectedSigner(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+
+	// Add a signature from a server which has nothing to do with the event.
+	_, unrelatedKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := room.events[1].Sign("c.com", "ed25519:unrelated", unrelatedKey)
+	room.events[1] = &signed
+
+	// By default the extra signature is tolerated.
+	loader := NewEventsLoader(RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false)
+	results, err := loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			t.Fatalf("got error %s, want none", result.Error)
+		}
+	}
+
+	// With the strict setting the event with the extra signature is rejected.
+	loader = NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithUnexpectedSignerCheck(true),
+	)
+	results, err = loader.LoadAndVerify(context.Background(), room.rawEvents(), TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if results[0].Error != nil || results[0].Event.Type() != MRoomCreate {
+		t.Fatalf("expected create event to be accepted, got %+v", results[0])
+	}
+	if _, ok := results[1].Error.(UnexpectedSignerErr); !ok || !strings.Contains(results[1].Error.Error(), "c.com") {
+		t.Fatalf("expected join event to be rejected for a signature from c.com, got %v", results[1].Error)
+	}
+}
+
+// testServerJSONVerifier accepts signatures from the given servers only.
+type testServerJSONVerifier struct {
+	servers []ServerName
+}
+
+func (v *testServerJSONVerifier) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	results := make([]VerifyJSONResult, len(requests))
+	for i, request := range requests {
+		results[i].Error = fmt.Errorf("no signature from %s", request.ServerName)
+		for _, serverName := range v.servers {
+			if request.ServerName == serverName {
+				results[i].Error = nil
+			}
+		}
+	}
+	return results, nil
+}
+
+func TestLoaderRelaxedEventIDs(t *testing.T) {
+	room := newTestLoaderRoom(t, RoomVersionV1, "a.com")
+	emptyStateKey := ""
+	create := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomCreate,
+		StateKey: &emptyStateKey,
+	}
+	mustBuilderContent(t, &create, map[string]interface{}{
+		"creator": "@alice:a.com",
+	})
+	room.build(create)
+
+	// Give the event a legacy event ID from a server which didn't sign it.
+	legacyJSON, err := sjson.SetBytes(room.events[0].JSON(), "event_id", "$legacy:b.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacyJSON, err = addContentHashesToEvent(legacyJSON, RoomVersionV1); err != nil {
+		t.Fatal(err)
+	}
+	rawEvents := []json.RawMessage{legacyJSON}
+	verifier := &testServerJSONVerifier{servers: []ServerName{"a.com"}}
+
+	// By default the server of the event ID must have signed the event.
+	loader := NewEventsLoader(RoomVersionV1, verifier, &testAuthStateProvider{}, room.provider, false)
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if _, ok := results[0].Error.(SignatureErr); !ok || !strings.Contains(results[0].Error.Error(), "b.com") {
+		t.Fatalf("expected legacy event to be rejected for a missing signature from b.com, got %v", results[0].Error)
+	}
+
+	// In relaxed mode the event ID is trusted.
+	loader = NewEventsLoader(
+		RoomVersionV1, verifier, &testAuthStateProvider{}, room.provider, false,
+		WithRelaxedEventIDs(true),
+	)
+	results, err = loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if results[0].Error != nil {
+		t.Fatalf("expected legacy event to be accepted in relaxed mode, got %s", results[0].Error)
+	}
+	if results[0].Event.EventID() != "$legacy:b.com" {
+		t.Fatalf("got event ID %s, want $legacy:b.com", results[0].Event.EventID())
+	}
+	if results[0].Event.Redacted() {
+		t.Fatalf("expected legacy event not to be redacted")
+	}
+}
+
+func TestLoaderRoomVersionMatchesCreate(t *testing.T) {
+	// The create event declares room version 9. Room version 6 has the same
+	// event format, so the events can still be parsed as room version 6.
+	room := newTestLoaderRoom(t, RoomVersionV9, "a.com")
+	emptyStateKey := ""
+	create := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomCreate,
+		StateKey: &emptyStateKey,
+	}
+	mustBuilderContent(t, &create, map[string]interface{}{
+		"creator":      "@alice:a.com",
+		"room_version": RoomVersionV9,
+	})
+	room.build(create)
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+	// Only load the member event, so that the create event comes from the provider.
+	rawEvents := room.rawEvents()[1:]
+
+	// Loading the member event with the declared room version is fine.
+	loader := NewEventsLoader(
+		RoomVersionV9, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithRoomVersionMatchesCreateCheck(true),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("expected member event to be accepted as room version 9, got %+v", results)
+	}
+
+	// Loading the member event with a different room version is rejected.
+	loader = NewEventsLoader(
+		RoomVersionV6, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithRoomVersionMatchesCreateCheck(true),
+	)
+	results, err = loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if _, ok := results[0].Error.(RoomVersionErr); !ok || !strings.Contains(results[0].Error.Error(), "declares room version") {
+		t.Fatalf("expected member event loaded as room version 6 to be rejected, got %v", results[0].Error)
+	}
+}
+
+func TestLoaderRoomVersionMatchesVerifiedCreate(t *testing.T) {
+	room := newTestLoaderRoom(t, RoomVersionV9, "a.com")
+	emptyStateKey := ""
+	create := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomCreate,
+		StateKey: &emptyStateKey,
+	}
+	mustBuilderContent(t, &create, map[string]interface{}{
+		"creator":      "@alice:a.com",
+		"room_version": RoomVersionV9,
+	})
+	room.build(create)
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+	rawEvents := room.rawEvents()
+
+	// Tamper with the room version of the create event in the batch. The
+	// content hash no longer matches, so the loader must not believe it and
+	// has to use the create event from the provider instead.
+	tampered, err := sjson.SetBytes(rawEvents[0], "content.room_version", RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to tamper with create event: %s", err)
+	}
+	rawEvents[0] = tampered
+
+	loader := NewEventsLoader(
+		RoomVersionV6, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false,
+		WithRoomVersionMatchesCreateCheck(true),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	for _, result := range results {
+		if result.Event == nil || result.Event.Type() != MRoomMember {
+			continue
+		}
+		if _, ok := result.Error.(RoomVersionErr); !ok || !strings.Contains(result.Error.Error(), "declares room version") {
+			t.Fatalf("expected member event loaded as room version 6 to be rejected, got %v", result.Error)
+		}
+		return
+	}
+	t.Fatalf("member event missing from results: %+v", results)
+}
+
+func TestLoaderForwardExtremities(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	create := room.events[0]
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	extremity := room.build(join)
+
+	// This message extends the forward extremity.
+	extending := EventBuilder{
+		Sender: "@alice:a.com",
+		RoomID: "!room:a.com",
+		Type:   "m.room.message",
+	}
+	mustBuilderContent(t, &extending, map[string]interface{}{"body": "extending"})
+	extendingEvent := room.build(extending)
+
+	// This message refers to the create event, so forks the room DAG.
+	forking := EventBuilder{
+		Sender:     "@alice:a.com",
+		RoomID:     "!room:a.com",
+		Type:       "m.room.message",
+		PrevEvents: []string{create.EventID()},
+	}
+	mustBuilderContent(t, &forking, map[string]interface{}{"body": "forking"})
+	forkingEvent := room.build(forking)
+
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{room: room}, room.provider, true,
+		WithForwardExtremities([]string{extremity.EventID()}),
+	)
+	rawEvents := []json.RawMessage{extendingEvent.JSON(), forkingEvent.JSON()}
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByPrevEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			t.Fatalf("got error %s, want none", result.Error)
+		}
+		if result.SoftFail {
+			t.Errorf("event %s was soft-failed, but the sender is joined in the current state", result.Event.EventID())
+		}
+		switch result.Event.EventID() {
+		case extendingEvent.EventID():
+			if !result.ExtendsExtremity {
+				t.Errorf("expected event %s to extend the forward extremity", result.Event.EventID())
+			}
+		case forkingEvent.EventID():
+			if result.ExtendsExtremity {
+				t.Errorf("expected event %s to fork the room DAG", result.Event.EventID())
+			}
+		}
+	}
+}
+
+func TestLoaderSoftFailAtForwardExtremities(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	joinEvent := room.build(join)
+	leave := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &leave, map[string]interface{}{
+		"membership": Leave,
+	})
+	leaveEvent := room.build(leave)
+
+	// The message is allowed by its auth events, from before alice left,
+	// but not by the current state of the room.
+	message := EventBuilder{
+		Sender:     "@alice:a.com",
+		RoomID:     "!room:a.com",
+		Type:       "m.room.message",
+		AuthEvents: []string{room.events[0].EventID(), joinEvent.EventID()},
+		PrevEvents: []string{joinEvent.EventID()},
+	}
+	mustBuilderContent(t, &message, map[string]interface{}{"body": "hello"})
+	messageEvent := room.build(message)
+
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{room: room}, room.provider, true,
+		WithForwardExtremities([]string{leaveEvent.EventID()}),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), []json.RawMessage{messageEvent.JSON()}, TopologicalOrderByPrevEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("expected message to be accepted, got %+v", results)
+	}
+	if !results[0].SoftFail {
+		t.Errorf("expected message to be soft-failed, since the sender has left in the current state")
+	}
+	if results[0].ExtendsExtremity {
+		t.Errorf("expected message to fork the room DAG")
+	}
+}
+
+func TestLoaderSoftFailWithoutCurrentState(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+	message := EventBuilder{
+		Sender: "@alice:a.com",
+		RoomID: "!room:a.com",
+		Type:   "m.room.message",
+	}
+	mustBuilderContent(t, &message, map[string]interface{}{"body": "hello"})
+	messageEvent := room.build(message)
+	reply := EventBuilder{
+		Sender: "@alice:a.com",
+		RoomID: "!room:a.com",
+		Type:   "m.room.message",
+	}
+	mustBuilderContent(t, &reply, map[string]interface{}{"body": "hello again"})
+	replyEvent := room.build(reply)
+
+	// The state provider doesn't know the state at the forward extremity, so
+	// the soft-fail check can't be performed.
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, true,
+		WithForwardExtremities([]string{messageEvent.EventID()}),
+	)
+	if _, err := loader.LoadAndVerify(context.Background(), []json.RawMessage{replyEvent.JSON()}, TopologicalOrderByPrevEvents); err == nil {
+		t.Fatalf("expected LoadAndVerify to return an error without any current state")
+	}
+}
+
+func TestLoaderSoftFailAfterEarlierBatchEvents(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	joinEvent := room.build(join)
+	leave := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &leave, map[string]interface{}{
+		"membership": Leave,
+	})
+	leaveEvent := room.build(leave)
+
+	// The message follows the leave in the same batch, so it must be checked
+	// against the state after the leave, even though the forward extremity
+	// is the join.
+	message := EventBuilder{
+		Sender:     "@alice:a.com",
+		RoomID:     "!room:a.com",
+		Type:       "m.room.message",
+		AuthEvents: []string{room.events[0].EventID(), joinEvent.EventID()},
+		PrevEvents: []string{leaveEvent.EventID()},
+	}
+	mustBuilderContent(t, &message, map[string]interface{}{"body": "hello"})
+	messageEvent := room.build(message)
+
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{room: room}, room.provider, true,
+		WithForwardExtremities([]string{joinEvent.EventID()}),
+	)
+	rawEvents := []json.RawMessage{messageEvent.JSON(), leaveEvent.JSON()}
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByPrevEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			t.Fatalf("got error %s, want none", result.Error)
+		}
+		if !result.ExtendsExtremity {
+			t.Errorf("expected event %s to extend a forward extremity", result.Event.EventID())
+		}
+		switch result.Event.EventID() {
+		case leaveEvent.EventID():
+			if result.SoftFail {
+				t.Errorf("expected leave to be accepted, since the sender is joined in the current state")
+			}
+		case messageEvent.EventID():
+			if !result.SoftFail {
+				t.Errorf("expected message to be soft-failed, since the sender left earlier in the batch")
+			}
+		}
+	}
+}
+
+func TestLoaderMultipleForwardExtremities(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	joinEvent := room.build(join)
+	var extremities []string
+	for _, body := range []string{"first", "second"} {
+		message := EventBuilder{
+			Sender:     "@alice:a.com",
+			RoomID:     "!room:a.com",
+			Type:       "m.room.message",
+			PrevEvents: []string{joinEvent.EventID()},
+		}
+		mustBuilderContent(t, &message, map[string]interface{}{"body": body})
+		extremities = append(extremities, room.build(message).EventID())
+	}
+	merge := EventBuilder{
+		Sender:     "@alice:a.com",
+		RoomID:     "!room:a.com",
+		Type:       "m.room.message",
+		PrevEvents: extremities,
+	}
+	mustBuilderContent(t, &merge, map[string]interface{}{"body": "merge"})
+	mergeEvent := room.build(merge)
+
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{room: room}, room.provider, true,
+		WithForwardExtremities(extremities),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), []json.RawMessage{mergeEvent.JSON()}, TopologicalOrderByPrevEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("expected message to be accepted, got %+v", results)
+	}
+	if results[0].SoftFail {
+		t.Errorf("expected message not to be soft-failed, since the sender is joined in the resolved state")
+	}
+	if !results[0].ExtendsExtremity {
+		t.Errorf("expected message to extend the forward extremities")
+	}
+}
+
+func TestLoaderSoftFailSecondCreateEvent(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	joinEvent := room.build(join)
+
+	// A second create event for the same room is allowed by the auth rules,
+	// since the state before it is empty, but not by the current state.
+	other := createTestLoaderRoom(t, "!room:a.com", "@mallory:a.com")
+	loader := NewEventsLoader(
+		RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{room: room}, room.provider, true,
+		WithForwardExtremities([]string{joinEvent.EventID()}),
+	)
+	results, err := loader.LoadAndVerify(context.Background(), other.rawEvents(), TopologicalOrderByPrevEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 1 || results[0].Error != nil {
+		t.Fatalf("expected create event to pass the auth rules, got %+v", results)
+	}
+	if !results[0].SoftFail {
+		t.Errorf("expected a second create event to be soft-failed")
+	}
+}
+
+func TestLoaderRejectSecondCreateEvent(t *testing.T) {
+	// The fake create event is made first so that it doesn't come later in
+	// the topological order than the real one.
+	fake := createTestLoaderRoom(t, "!room:a.com", "@mallory:a.com")
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	join := EventBuilder{
+		Sender:   "@alice:a.com",
+		RoomID:   "!room:a.com",
+		Type:     MRoomMember,
+		StateKey: &aliceStateKey,
+	}
+	mustBuilderContent(t, &join, map[string]interface{}{
+		"membership": Join,
+	})
+	room.build(join)
+
+	// No soft-fail check or forward extremities are needed to reject it.
+	loader := NewEventsLoader(RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, room.provider, false)
+	rawEvents := append(fake.rawEvents(), room.rawEvents()...)
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByAuthEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for _, result := range results {
+		if result.Event.EventID() == fake.events[0].EventID() {
+			if _, ok := result.Error.(AuthRulesErr); !ok {
+				t.Fatalf("expected a second create event to be rejected, got %v", result.Error)
+			}
+		} else if result.Error != nil {
+			t.Fatalf("expected event %s to be accepted, got %s", result.Event.EventID(), result.Error)
+		}
+	}
+}
+
+func TestLoaderRedactionTarget(t *testing.T) {
+	room := createTestLoaderRoom(t, "!room:a.com", "@alice:a.com")
+	other := createTestLoaderRoom(t, "!other:a.com", "@alice:a.com")
+	aliceStateKey := "@alice:a.com"
+	for _, r := range []*testLoaderRoom{room, other} {
+		join := EventBuilder{
+			Sender:   "@alice:a.com",
+			RoomID:   r.events[0].RoomID(),
+			Type:     MRoomMember,
+			StateKey: &aliceStateKey,
+		}
+		mustBuilderContent(t, &join, map[string]interface{}{
+			"membership": Join,
+		})
+		r.build(join)
+	}
+	message := EventBuilder{
+		Sender: "@alice:a.com",
+		RoomID: "!other:a.com",
+		Type:   "m.room.message",
+	}
+	mustBuilderContent(t, &message, map[string]interface{}{
+		"body": "hello",
+	})
+	target := other.build(message)
+	redaction := EventBuilder{
+		Sender:  "@alice:a.com",
+		RoomID:  "!room:a.com",
+		Type:    MRoomRedaction,
+		Redacts: target.EventID(),
+	}
+	mustBuilderContent(t, &redaction, map[string]interface{}{})
+	redactionEvent := room.build(redaction)
+
+	provider := func(roomVer RoomVersion, eventIDs []string) ([]*Event, error) {
+		events, _ := room.provider(roomVer, eventIDs)
+		otherEvents, _ := other.provider(roomVer, eventIDs)
+		return append(events, otherEvents...), nil
+	}
+	loader := NewEventsLoader(RoomVersionV10, &testNopJSONVerifier{}, &testAuthStateProvider{}, provider, false)
+	rawEvents := append(room.rawEvents(), other.rawEvents()...)
+	results, err := loader.LoadAndVerify(context.Background(), rawEvents, TopologicalOrderByPrevEvents)
+	if err != nil {
+		t.Fatalf("LoadAndVerify returned an error: %s", err)
+	}
+	for _, result := range results {
+		if result.Event.EventID() == redactionEvent.EventID() {
+			if _, ok := result.Error.(AuthRulesErr); !ok {
+				t.Fatalf("expected redaction of an event in another room to be rejected, got %v", result.Error)
+			}
+		} else if result.Error != nil {
+			t.Fatalf("expected event %s to be accepted, got %s", result.Event.EventID(), result.Error)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package gomatrixserverlib
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// A ProtoEvent is an unsigned event template, as returned by the
+// /make_join, /make_leave and /make_knock federation endpoints. It has
+// no hashes, signatures or event ID - these are added by ToEvent.
+type ProtoEvent struct {
+	// The user ID of the user sending the event.
+	Sender string `json:"sender"`
+	// The room ID of the room this event is in.
+	RoomID string `json:"room_id"`
+	// The type of the event.
+	Type string `json:"type"`
+	// The state_key of the event if the event is a state event or nil if the event is not a state event.
+	StateKey *string `json:"state_key,omitempty"`
+	// The events that immediately preceded this event in the room history. This can be
+	// either []EventReference for room v1/v2, and []string for room v3 onwards.
+	PrevEvents interface{} `json:"prev_events"`
+	// The events needed to authenticate this event. This can be
+	// either []EventReference for room v1/v2, and []string for room v3 onwards.
+	AuthEvents interface{} `json:"auth_events"`
+	// The event ID of the event being redacted if this event is a "m.room.redaction".
+	Redacts string `json:"redacts,omitempty"`
+	// The depth of the event.
+	Depth int64 `json:"depth"`
+	// The JSON object for "content" key of the event.
+	Content RawJSON `json:"content"`
+	// The timestamp of the event. If this is zero then the current time is
+	// used when the event is completed by ToEvent.
+	OriginServerTS Timestamp `json:"origin_server_ts,omitempty"`
+}
+
+// ToEvent completes the template by adding the content hashes and event ID,
+// as appropriate for the room version, and signs it with the given key,
+// returning the resulting event.
+func (p *ProtoEvent) ToEvent(
+	roomVer RoomVersion, keyID KeyID, key ed25519.PrivateKey, origin ServerName,
+) (*Event, error) {
+	now := time.Now()
+	if p.OriginServerTS != 0 {
+		now = p.OriginServerTS.Time()
+	}
+	eb := EventBuilder{
+		Sender:     p.Sender,
+		RoomID:     p.RoomID,
+		Type:       p.Type,
+		StateKey:   p.StateKey,
+		PrevEvents: p.PrevEvents,
+		AuthEvents: p.AuthEvents,
+		Redacts:    p.Redacts,
+		Depth:      p.Depth,
+		Content:    p.Content,
+	}
+	return eb.Build(now, origin, keyID, key, roomVer)
+}
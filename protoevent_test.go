@@ -0,0 +1,60 @@
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestProtoEventToEvent(t *testing.T) {
+	// A template as it might be returned by /make_join.
+	template := `{
+		"type": "m.room.member",
+		"state_key": "@bob:b.com",
+		"sender": "@bob:b.com",
+		"room_id": "!room:a.com",
+		"content": {"membership": "join"},
+		"prev_events": ["$prev"],
+		"auth_events": ["$create", "$power_levels", "$join_rules"],
+		"depth": 5,
+		"origin_server_ts": 1234567890
+	}`
+	var proto ProtoEvent
+	if err := json.Unmarshal([]byte(template), &proto); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := proto.ToEvent(RoomVersionV10, "ed25519:test", privateKey, "b.com")
+	if err != nil {
+		t.Fatalf("ToEvent failed: %s", err)
+	}
+
+	// The completed event should pass the checks for untrusted events,
+	// including the content hash check, without being redacted.
+	event, err = NewEventFromUntrustedJSON(event.JSON(), RoomVersionV10)
+	if err != nil {
+		t.Fatalf("NewEventFromUntrustedJSON failed: %s", err)
+	}
+	if event.Redacted() {
+		t.Fatalf("event was redacted, content hash is invalid")
+	}
+	if event.Depth() != 5 || event.OriginServerTS() != 1234567890 {
+		t.Fatalf("event has wrong depth %d or timestamp %d", event.Depth(), event.OriginServerTS())
+	}
+	if len(event.AuthEventIDs()) != 3 || len(event.PrevEventIDs()) != 1 {
+		t.Fatalf("event has wrong auth events %v or prev events %v", event.AuthEventIDs(), event.PrevEventIDs())
+	}
+
+	// The event should be signed by the origin.
+	redacted, err := RedactEventJSON(event.JSON(), RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyJSON("b.com", "ed25519:test", publicKey, redacted); err != nil {
+		t.Fatalf("event signature is invalid: %s", err)
+	}
+}
@@ -46,8 +46,14 @@ func NewFederationRequest(method string, destination ServerName, requestURI stri
 }
 
 // SetContent sets the JSON content for the request.
-// Returns an error if there already is JSON content present on the request.
+// Returns an error if there already is JSON content present on the request,
+// or if the request is a GET request. GET requests have no body, so the
+// "content" key must be omitted from the signed JSON rather than included
+// as an empty object.
 func (r *FederationRequest) SetContent(content interface{}) error {
+	if r.fields.Method == http.MethodGet {
+		return fmt.Errorf("gomatrixserverlib: GET requests cannot have content")
+	}
 	if r.fields.Content != nil {
 		return fmt.Errorf("gomatrixserverlib: content already set on the request")
 	}
@@ -257,6 +263,53 @@ func VerifyHTTPRequest(
 	return request, util.JSONResponse{Code: 200, JSON: struct{}{}}
 }
 
+// RequestBodyTooLargeError is returned by ReadFederationRequestBody if the
+// request body is larger than the maximum allowed size. Handlers should
+// respond to this with a 413 status code.
+type RequestBodyTooLargeError struct {
+	MaxBytes int64
+}
+
+func (e RequestBodyTooLargeError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: request body is too large, maximum %d bytes", e.MaxBytes)
+}
+
+// ReadFederationRequestBody reads the body of an inbound federation request,
+// reading no more than maxBytes bytes. If the body is larger than maxBytes then
+// a RequestBodyTooLargeError is returned. If the body is not empty then the
+// request must have an "application/json" Content-Type and the body must be
+// valid UTF-8, otherwise an error is returned.
+func ReadFederationRequestBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	if r.ContentLength > maxBytes {
+		return nil, RequestBodyTooLargeError{MaxBytes: maxBytes}
+	}
+	content, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBytes))
+	if err != nil {
+		// The MaxBytesReader returns an error once the limit has been reached
+		// and there is still more to read.
+		if int64(len(content)) >= maxBytes {
+			return nil, RequestBodyTooLargeError{MaxBytes: maxBytes}
+		}
+		return nil, err
+	}
+	if len(content) == 0 {
+		return content, nil
+	}
+	mimetype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: The request had an invalid Content-Type header: %w", err)
+	}
+	if mimetype != "application/json" {
+		return nil, fmt.Errorf("gomatrixserverlib: The request must be \"application/json\" not %q", mimetype)
+	}
+	// check for invalid utf-8
+	// https://matrix.org/docs/spec/server_server/r0.1.4#api-standards
+	if !utf8.Valid(content) {
+		return nil, fmt.Errorf("gomatrixserverlib: The request contained invalid UTF-8")
+	}
+	return content, nil
+}
+
 // Returns an error if there was a problem reading the content of the request
 func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint: gocyclo
 	var result FederationRequest
@@ -268,7 +321,10 @@ func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint:
 	if err != nil {
 		return nil, err
 	}
-	if len(content) != 0 {
+	// GET requests have no content, so any body is ignored and the "content"
+	// key is omitted from the JSON to verify, in the same way as SetContent
+	// refuses to set content on GET requests that we send.
+	if len(content) != 0 && req.Method != http.MethodGet {
 		mimetype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
 		if err != nil {
 			return nil, fmt.Errorf("gomatrixserverlib: The request had an invalid Content-Type header: %w", err)
@@ -4,10 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/util"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -161,6 +165,88 @@ func TestVerifyPutRequest(t *testing.T) {
 	}
 }
 
+// verifyWrittenRequest writes out the request and then reads it back in and
+// verifies it, as a receiving server would.
+func verifyWrittenRequest(t *testing.T, hr *http.Request) (*FederationRequest, util.JSONResponse) {
+	t.Helper()
+	hr.Header.Set("User-Agent", "")
+	buf := bytes.NewBuffer(nil)
+	if err := hr.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	received, err := http.ReadRequest(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return VerifyHTTPRequest(
+		received, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{nil, &testKeyDatabase{}},
+	)
+}
+
+func TestSignAndVerifyGetRequest(t *testing.T) {
+	request := NewFederationRequest("GET", "localhost:44033", "/_matrix/federation/v1/event/%24event")
+	if err := request.SetContent(struct{}{}); err == nil {
+		t.Fatalf("Wanted SetContent on a GET request to fail")
+	}
+	if err := request.Sign("localhost:8800", "ed25519:a_Obwu", privateKey1); err != nil {
+		t.Fatal(err)
+	}
+	hr, err := request.HTTPRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, jsonResp := verifyWrittenRequest(t, hr)
+	if verified == nil {
+		t.Fatalf("Wanted non-nil request got nil. (response was %#v)", jsonResp)
+	}
+	if verified.Content() != nil {
+		t.Errorf("Wanted request.Content() to be nil got %q", string(verified.Content()))
+	}
+}
+
+func TestVerifyGetRequestSignedWithEmptyContent(t *testing.T) {
+	// Sign the request as if the GET request had an empty object as its body.
+	// The spec requires the "content" key to be omitted for requests with no
+	// body, so the signature won't match what the receiver verifies.
+	signed, err := SignJSON("localhost:8800", "ed25519:a_Obwu", privateKey1, []byte(`{
+		"content": {},
+		"destination": "localhost:44033",
+		"method": "GET",
+		"origin": "localhost:8800",
+		"uri": "/_matrix/federation/v1/event/%24event"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields struct {
+		Signatures map[ServerName]map[KeyID]string `json:"signatures"`
+	}
+	if err = json.Unmarshal(signed, &fields); err != nil {
+		t.Fatal(err)
+	}
+	sig := fields.Signatures["localhost:8800"]["ed25519:a_Obwu"]
+
+	for _, body := range []string{"", "{}"} {
+		hr, err := http.NewRequest("GET", "matrix://localhost:44033/_matrix/federation/v1/event/%24event", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			hr.Header.Set("Content-Type", "application/json")
+		}
+		hr.Header.Set("Authorization", fmt.Sprintf(
+			"X-Matrix origin=\"localhost:8800\",key=\"ed25519:a_Obwu\",sig=\"%s\",destination=\"localhost:44033\"", sig,
+		))
+		verified, jsonResp := verifyWrittenRequest(t, hr)
+		if verified != nil {
+			t.Fatalf("Wanted GET request signed with content and body %q to be rejected", body)
+		}
+		if jsonResp.Code != 401 {
+			t.Fatalf("Wanted a 401 response for body %q, got %d", body, jsonResp.Code)
+		}
+	}
+}
+
 var privateKey1 = mustLoadPrivateKey(privateKeySeed1)
 
 func mustLoadPrivateKey(seed string) ed25519.PrivateKey {
@@ -175,3 +261,48 @@ func mustLoadPrivateKey(seed string) ed25519.PrivateKey {
 	}
 	return privateKey
 }
+
+func TestReadFederationRequestBody(t *testing.T) {
+	body := []byte(`{"foo":"bar"}`)
+	req, err := http.NewRequest("PUT", "/_matrix/federation/v1/send/1", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	content, err := ReadFederationRequestBody(req, int64(len(body)))
+	if err != nil {
+		t.Fatalf("ReadFederationRequestBody failed: %s", err)
+	}
+	if !bytes.Equal(content, body) {
+		t.Fatalf("got body %q, expected %q", string(content), string(body))
+	}
+}
+
+func TestReadFederationRequestBodyTooLarge(t *testing.T) {
+	body := []byte(`{"foo":"bar"}`)
+	for _, contentLength := range []int64{int64(len(body)), -1} {
+		req, err := http.NewRequest("PUT", "/_matrix/federation/v1/send/1", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		// A content length of -1 means that the length is unknown, so the
+		// limit has to be enforced while reading the body.
+		req.ContentLength = contentLength
+		_, err = ReadFederationRequestBody(req, int64(len(body))-1)
+		if _, ok := err.(RequestBodyTooLargeError); !ok {
+			t.Fatalf("expected RequestBodyTooLargeError with content length %d, got %v", contentLength, err)
+		}
+	}
+}
+
+func TestReadFederationRequestBodyWrongContentType(t *testing.T) {
+	req, err := http.NewRequest("PUT", "/_matrix/federation/v1/send/1", bytes.NewReader([]byte(`{}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if _, err = ReadFederationRequestBody(req, 1024); err == nil {
+		t.Fatalf("expected request with the wrong content type to be rejected")
+	}
+}
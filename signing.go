@@ -98,7 +98,7 @@ func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, me
 	// This allows us to add and remove the top-level keys from the JSON object.
 	// It also ensures that the JSON is actually a valid JSON object.
 	var object map[string]*json.RawMessage
-	var signatures map[string]map[KeyID]Base64Bytes
+	var signatures map[string]map[KeyID]string
 	if err := json.Unmarshal(message, &object); err != nil {
 		return err
 	}
@@ -110,12 +110,21 @@ func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, me
 	if err := json.Unmarshal(*object["signatures"], &signatures); err != nil {
 		return err
 	}
-	signature, ok := signatures[signingName][keyID]
+	encoded, ok := signatures[signingName][keyID]
 	if !ok {
 		return fmt.Errorf("No signature from %q with ID %q", signingName, keyID)
 	}
+	// Only decode the signature that we need, so that a malformed signature
+	// from some other entity doesn't stop us from checking this one.
+	var signature Base64Bytes
+	if err := signature.Decode(encoded); err != nil {
+		return MalformedSignatureError{signingName, keyID, "invalid base64: " + err.Error()}
+	}
 	if len(signature) != ed25519.SignatureSize {
-		return fmt.Errorf("Bad signature length from %q with ID %q", signingName, keyID)
+		return MalformedSignatureError{
+			signingName, keyID,
+			fmt.Sprintf("decoded to %d bytes, expected %d", len(signature), ed25519.SignatureSize),
+		}
 	}
 
 	// The "unsigned" key and "signatures" keys aren't covered by the signature so remove them.
@@ -221,3 +221,51 @@ func TestSignJSONWithUnsigned(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestVerifyJSONMalformedSignature(t *testing.T) {
+	entityName := "domain"
+	keyID := KeyID("ed25519:1")
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for reason, signature := range map[string]string{
+		"truncated":      "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV",
+		"invalid base64": "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZA!",
+	} {
+		input := `{"signatures": {"domain": {"ed25519:1": "` + signature + `"}}}`
+		err := VerifyJSON(entityName, keyID, publicKey, []byte(input))
+		malformed, ok := err.(MalformedSignatureError)
+		if !ok {
+			t.Fatalf("Expected MalformedSignatureError for %s signature, got %v", reason, err)
+		}
+		if malformed.SigningName != entityName || malformed.KeyID != keyID {
+			t.Errorf("Expected error for %q with ID %q, got %q with ID %q", entityName, keyID, malformed.SigningName, malformed.KeyID)
+		}
+	}
+}
+
+func TestVerifyJSONIgnoresOtherMalformedSignatures(t *testing.T) {
+	entityName := "domain"
+	keyID := KeyID("ed25519:1")
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignJSON(entityName, keyID, privateKey, []byte(`{"foo":"bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]interface{}
+	if err = json.Unmarshal(signed, &object); err != nil {
+		t.Fatal(err)
+	}
+	object["signatures"].(map[string]interface{})["other"] = map[string]interface{}{"ed25519:1": "!!!"}
+	if signed, err = json.Marshal(object); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyJSON(entityName, keyID, publicKey, signed); err != nil {
+		t.Fatalf("Expected a malformed signature from another server to be ignored, got %v", err)
+	}
+}
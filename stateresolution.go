@@ -312,12 +312,25 @@ func (s conflictedEventSorter) Swap(i, j int) {
 // resolved state. It will automatically decide which state resolution algorithm
 // to use, depending on the room version. `events` should be all the state events
 // to resolve. `authEvents` should be the entire set of auth_events for these `events`.
-// Returns an error if the state resolution algorithm cannot be determined.
+// Returns an error if the state resolution algorithm cannot be determined, or
+// if the events are not all in the same room and of the given room version.
 func ResolveConflicts(
 	version RoomVersion,
 	events []*Event,
 	authEvents []*Event,
 ) ([]*Event, error) {
+	allEvents := make([]*Event, 0, len(events)+len(authEvents))
+	allEvents = append(append(allEvents, events...), authEvents...)
+	if err := SameRoomAndVersion(allEvents); err != nil {
+		return nil, err
+	}
+	if len(allEvents) > 0 && allEvents[0].roomVersion != version {
+		return nil, fmt.Errorf(
+			"gomatrixserverlib: cannot resolve state for room version %q using events of room version %q",
+			version, allEvents[0].roomVersion,
+		)
+	}
+
 	type stateKeyTuple struct {
 		Type     string
 		StateKey string
@@ -384,3 +397,70 @@ func ResolveConflicts(
 	// resolved set of conflicted events, and the unconflicted events.
 	return resolved, nil
 }
+
+// StateMap returns the given state events keyed by their (type, state_key)
+// tuple, which is usually more convenient than the slice returned by state
+// resolution. Events that aren't state events are ignored. If there is more
+// than one event for a tuple then the last one in the slice is used.
+func StateMap(state []*Event) map[StateKeyTuple]*Event {
+	result := make(map[StateKeyTuple]*Event, len(state))
+	for _, event := range state {
+		if event.StateKey() == nil {
+			continue
+		}
+		result[StateKeyTuple{event.Type(), *event.StateKey()}] = event
+	}
+	return result
+}
+
+// StateSlice is the inverse of StateMap, returning the state events in the
+// map as a slice. The events are sorted by type and then state key so that
+// the result is the same each time for a given map.
+func StateSlice(m map[StateKeyTuple]*Event) []*Event {
+	tuples := make([]StateKeyTuple, 0, len(m))
+	for tuple := range m {
+		tuples = append(tuples, tuple)
+	}
+	sort.Slice(tuples, func(i, j int) bool {
+		if tuples[i].EventType != tuples[j].EventType {
+			return tuples[i].EventType < tuples[j].EventType
+		}
+		return tuples[i].StateKey < tuples[j].StateKey
+	})
+	result := make([]*Event, 0, len(tuples))
+	for _, tuple := range tuples {
+		result = append(result, m[tuple])
+	}
+	return result
+}
+
+// FindDuplicateState returns the (type, state_key) tuples which have more than
+// one event in the given state, in the order that they first appear. A valid
+// room state has at most one event for each tuple, so a non-empty result means
+// that the state is malformed. The same event appearing more than once isn't
+// counted as a duplicate, and events that aren't state events are ignored.
+func FindDuplicateState(state []*Event) []StateKeyTuple {
+	seenEventIDs := make(map[string]struct{}, len(state))
+	counts := make(map[StateKeyTuple]int, len(state))
+	var tuples, duplicates []StateKeyTuple
+	for _, event := range state {
+		if event.StateKey() == nil {
+			continue
+		}
+		if _, ok := seenEventIDs[event.EventID()]; ok {
+			continue
+		}
+		seenEventIDs[event.EventID()] = struct{}{}
+		tuple := StateKeyTuple{event.Type(), *event.StateKey()}
+		if counts[tuple] == 0 {
+			tuples = append(tuples, tuple)
+		}
+		counts[tuple]++
+	}
+	for _, tuple := range tuples {
+		if counts[tuple] > 1 {
+			duplicates = append(duplicates, tuple)
+		}
+	}
+	return duplicates
+}
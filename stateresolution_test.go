@@ -42,3 +42,73 @@ func TestConflictEventSorter(t *testing.T) {
 		}
 	}
 }
+
+func TestStateMapRoundTrip(t *testing.T) {
+	var state []*Event
+	for _, eventJSON := range []string{
+		`{"type":"m.room.create","state_key":"","event_id":"$create:a","room_id":"!r:a","sender":"@u1:a","content":{"creator":"@u1:a"}}`,
+		`{"type":"m.room.member","state_key":"@u1:a","event_id":"$u1:a","room_id":"!r:a","sender":"@u1:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.member","state_key":"@u2:b","event_id":"$u2:b","room_id":"!r:a","sender":"@u2:b","content":{"membership":"join"}}`,
+		`{"type":"m.room.name","state_key":"","event_id":"$name:a","room_id":"!r:a","sender":"@u1:a","content":{"name":"test"}}`,
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, event)
+	}
+	message, err := NewEventFromTrustedJSON([]byte(
+		`{"type":"m.room.message","event_id":"$msg:a","room_id":"!r:a","sender":"@u1:a","content":{"body":"hello"}}`,
+	), false, RoomVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateMap := StateMap(append(state, message))
+	if len(stateMap) != len(state) {
+		t.Fatalf("expected %d entries in the state map, got %d", len(state), len(stateMap))
+	}
+	if got := stateMap[StateKeyTuple{MRoomMember, "@u2:b"}]; got != state[2] {
+		t.Fatalf("expected member event for @u2:b, got %v", got)
+	}
+
+	// The state above is already sorted by type and state key.
+	roundTripped := StateSlice(stateMap)
+	if len(roundTripped) != len(state) {
+		t.Fatalf("expected %d events after the round trip, got %d", len(state), len(roundTripped))
+	}
+	for i := range state {
+		if roundTripped[i] != state[i] {
+			t.Fatalf("different event at index %d: wanted %s, got %s", i, state[i].EventID(), roundTripped[i].EventID())
+		}
+	}
+}
+
+func TestFindDuplicateState(t *testing.T) {
+	var state []*Event
+	for _, eventJSON := range []string{
+		`{"type":"m.room.create","state_key":"","event_id":"$create:a","room_id":"!r:a","sender":"@u1:a","content":{"creator":"@u1:a"}}`,
+		`{"type":"m.room.name","state_key":"","event_id":"$name1:a","room_id":"!r:a","sender":"@u1:a","content":{"name":"first"}}`,
+		`{"type":"m.room.member","state_key":"@u1:a","event_id":"$u1:a","room_id":"!r:a","sender":"@u1:a","content":{"membership":"join"}}`,
+		`{"type":"m.room.name","state_key":"","event_id":"$name2:a","room_id":"!r:a","sender":"@u1:a","content":{"name":"second"}}`,
+	} {
+		event, err := NewEventFromTrustedJSON([]byte(eventJSON), false, RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, event)
+	}
+
+	if got := FindDuplicateState(state[:3]); len(got) != 0 {
+		t.Fatalf("expected no duplicates, got %v", got)
+	}
+	// The same event appearing twice isn't a duplicate.
+	if got := FindDuplicateState(append(state[:3:3], state[1])); len(got) != 0 {
+		t.Fatalf("expected no duplicates for a repeated event, got %v", got)
+	}
+	got := FindDuplicateState(state)
+	want := []StateKeyTuple{{MRoomName, ""}}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Fatalf("expected duplicates %v, got %v", want, got)
+	}
+}
@@ -1,6 +1,10 @@
 package gomatrixserverlib
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 // A Transaction is used to push data from one matrix server to another matrix
 // server.
@@ -28,6 +32,62 @@ type Transaction struct {
 	EDUs []EDU `json:"edus,omitempty"`
 }
 
+// The maximum number of PDUs and EDUs that a transaction can contain.
+// https://matrix.org/docs/spec/server_server/latest#transactions
+const (
+	MaxTransactionPDUs = 50
+	MaxTransactionEDUs = 100
+)
+
+// A TransactionValidationOption can be supplied to Transaction.Validate to
+// enable additional, optional checks.
+type TransactionValidationOption func(*transactionValidation)
+
+type transactionValidation struct {
+	// The maximum distance from now that the origin_server_ts may be, or
+	// zero if the timestamp should not be checked.
+	originServerTSWindow time.Duration
+}
+
+// WithOriginServerTSWindow is an option that can be supplied to
+// Transaction.Validate. When supplied, transactions whose origin_server_ts
+// is more than the given duration in the past or in the future are rejected.
+// This can help to detect clock problems or replayed transactions.
+func WithOriginServerTSWindow(window time.Duration) TransactionValidationOption {
+	return func(v *transactionValidation) {
+		v.originServerTSWindow = window
+	}
+}
+
+// Validate checks that the transaction is within the limits set by the spec
+// on the number of PDUs and EDUs. Additional checks can be enabled by
+// supplying TransactionValidationOptions.
+func (t *Transaction) Validate(options ...TransactionValidationOption) error {
+	var v transactionValidation
+	for _, option := range options {
+		option(&v)
+	}
+	if l := len(t.PDUs); l > MaxTransactionPDUs {
+		return fmt.Errorf("gomatrixserverlib: transaction contains too many PDUs, %d > maximum %d", l, MaxTransactionPDUs)
+	}
+	if l := len(t.EDUs); l > MaxTransactionEDUs {
+		return fmt.Errorf("gomatrixserverlib: transaction contains too many EDUs, %d > maximum %d", l, MaxTransactionEDUs)
+	}
+	if v.originServerTSWindow > 0 {
+		skew := time.Since(t.OriginServerTS.Time())
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > v.originServerTSWindow {
+			return fmt.Errorf(
+				"gomatrixserverlib: transaction origin_server_ts %d is outside of the allowed window of %s",
+				t.OriginServerTS, v.originServerTSWindow,
+			)
+		}
+	}
+	return nil
+}
+
 // A TransactionID identifies a transaction sent by a matrix server to another
 // matrix server. The ID must be unique amongst the transactions sent from the
 // origin server to the destination, but doesn't have to be globally unique.
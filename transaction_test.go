@@ -0,0 +1,45 @@
+package gomatrixserverlib
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTransactionValidateOriginServerTS(t *testing.T) {
+	txn := Transaction{
+		TransactionID:  "txn1",
+		Origin:         "a.com",
+		Destination:    "b.com",
+		OriginServerTS: AsTimestamp(time.Now().Add(24 * time.Hour)),
+	}
+	// The timestamp isn't checked unless the option is supplied.
+	if err := txn.Validate(); err != nil {
+		t.Fatalf("expected transaction to be valid without the timestamp check, got %s", err)
+	}
+	if err := txn.Validate(WithOriginServerTSWindow(time.Hour)); err == nil {
+		t.Fatalf("expected transaction a day in the future to be rejected")
+	}
+	txn.OriginServerTS = AsTimestamp(time.Now().Add(-24 * time.Hour))
+	if err := txn.Validate(WithOriginServerTSWindow(time.Hour)); err == nil {
+		t.Fatalf("expected transaction a day in the past to be rejected")
+	}
+	txn.OriginServerTS = AsTimestamp(time.Now().Add(-time.Minute))
+	if err := txn.Validate(WithOriginServerTSWindow(time.Hour)); err != nil {
+		t.Fatalf("expected recent transaction to be valid, got %s", err)
+	}
+}
+
+func TestTransactionValidateTooManyPDUs(t *testing.T) {
+	txn := Transaction{
+		TransactionID: "txn1",
+		Origin:        "a.com",
+		Destination:   "b.com",
+	}
+	for i := 0; i <= MaxTransactionPDUs; i++ {
+		txn.PDUs = append(txn.PDUs, json.RawMessage(`{}`))
+	}
+	if err := txn.Validate(); err == nil {
+		t.Fatalf("expected transaction with %d PDUs to be rejected", len(txn.PDUs))
+	}
+}